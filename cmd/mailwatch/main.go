@@ -35,8 +35,8 @@ func main() {
 	log.Println("Waiting for new messages.")
 
 	for range tk.C {
-		// Check if we need to renew our session.
-		if s.Expired() {
+		// Check if we need to renew our session before it expires.
+		if time.Until(s.ExpiresAt()) < time.Minute {
 			log.Println("Renewing session..")
 			ok, err := s.Renew()
 			if !ok {
@@ -0,0 +1,32 @@
+package tmm
+
+// seenSet is a set of message IDs that forgets the oldest
+// once it holds more than max.
+type seenSet struct {
+	max   int
+	ids   map[string]bool
+	order []string
+}
+
+func newSeenSet(max int) *seenSet {
+	return &seenSet{
+		max: max,
+		ids: make(map[string]bool),
+	}
+}
+
+// add adds id to the set, returning false if it was already present.
+func (s *seenSet) add(id string) bool {
+	if s.ids[id] {
+		return false
+	}
+
+	s.ids[id] = true
+	s.order = append(s.order, id)
+	if len(s.order) > s.max {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	return true
+}
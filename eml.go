@@ -0,0 +1,68 @@
+package tmm
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"time"
+)
+
+// EML reconstructs the message in RFC 5322 form, suitable for saving
+// as a .eml file. The body is written as a multipart/alternative with
+// the plaintext and HTML versions of the message.
+func (m *Message) EML() ([]byte, error) {
+	return m.eml("")
+}
+
+// eml builds the message source, adding a To header if to is set.
+func (m *Message) eml(to string) ([]byte, error) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+
+	// Headers
+	fmt.Fprintf(&b, "From: %s\r\n", m.Sender)
+	if to != "" {
+		fmt.Fprintf(&b, "To: %s\r\n", to)
+	}
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", m.SentDate.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@10minutemail.com>\r\n", m.ID)
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", w.Boundary())
+
+	// Body parts, least preferred first
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", m.Plaintext},
+		{"text/html; charset=utf-8", m.HTML},
+	}
+
+	for _, p := range parts {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(p.body)); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,65 @@
+package tmm
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func TestEML(t *testing.T) {
+	m := Message{
+		ID:        "42",
+		SentDate:  time.Date(2021, 11, 28, 8, 21, 6, 0, time.UTC),
+		Sender:    "example@example.com",
+		Subject:   "Grüße",
+		Plaintext: "hello world",
+		HTML:      "<div>hello world<br></div>",
+	}
+
+	b, err := m.EML()
+	if err != nil {
+		t.Fatalf("unexpected error building eml: %s", err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("eml doesn't parse: %s", err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != m.Subject {
+		t.Errorf("Got subject %q, want %q", subject, m.Subject)
+	}
+
+	date, err := msg.Header.Date()
+	if err != nil || !date.Equal(m.SentDate) {
+		t.Errorf("Got date %s, want %s", date, m.SentDate)
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("bad content type: %s", err)
+	}
+
+	var bodies []string
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("bad multipart body: %s", err)
+		}
+		body, _ := io.ReadAll(p)
+		bodies = append(bodies, string(body))
+	}
+
+	if len(bodies) != 2 || bodies[0] != m.Plaintext || bodies[1] != m.HTML {
+		t.Errorf("Got bodies %q, want plaintext and html", bodies)
+	}
+}
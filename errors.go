@@ -0,0 +1,110 @@
+package tmm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RequestError is returned when a request to the server can't be made,
+// or its response can't be read or understood. It carries the URL of
+// the request and the underlying error.
+//
+// errors.Is reports it as matching Kind, which is one of
+// ErrBuildingRequest, ErrRequestFailed, ErrReadBody, ErrMarshalFailed
+// or ErrUnmarshalFailed.
+type RequestError struct {
+	Kind error
+	// The URL requested, if known.
+	URL string
+	// The error that caused the failure.
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+// Is reports whether target is the kind of failure.
+func (e *RequestError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned when the server responds with a status that
+// means the request was refused, or a response that doesn't make sense
+// for the status.
+//
+// errors.Is reports it as matching Kind, which is one of
+// ErrBlockedByServer, ErrMissingSession, ErrExpiredMessage or
+// ErrRequestFailed.
+type StatusError struct {
+	Kind error
+	// The URL requested.
+	URL string
+	// The status code of the response.
+	StatusCode int
+	// Any further description of what was wrong with the response.
+	Detail string
+}
+
+func (e *StatusError) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("%s: status %d, %s", e.Kind, e.StatusCode, e.Detail)
+	}
+
+	return fmt.Sprintf("%s: status %d", e.Kind, e.StatusCode)
+}
+
+// Is reports whether target is the kind of failure.
+func (e *StatusError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// BatchError is returned by operations carried out on many items, such
+// as forwarding every new message or fetching from every session in a
+// pool, when some of them fail. It records
+// which items failed and why. errors.Is and errors.As check each
+// cause.
+type BatchError struct {
+	Failures []BatchFailure
+}
+
+// BatchFailure describes the failure of one item in a batch.
+type BatchFailure struct {
+	// The position of the item in the batch.
+	Index int
+	// What the item is, such as a message ID. May be empty.
+	Key string
+	// Why the item failed.
+	Err error
+}
+
+func (e *BatchError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d failed: ", len(e.Failures))
+	for i, f := range e.Failures {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		key := f.Key
+		if key == "" {
+			key = "#" + strconv.Itoa(f.Index)
+		}
+		fmt.Fprintf(&b, "%s: %s", key, f.Err)
+	}
+
+	return b.String()
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+
+	return errs
+}
@@ -0,0 +1,54 @@
+package tmm
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestError(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`not json`))
+	})
+
+	_, err := s.SecondsLeft()
+
+	var rerr *RequestError
+	if !errors.As(err, &rerr) || !strings.HasSuffix(rerr.URL, endpointSecondsLeft) {
+		t.Fatalf("Got %v, want RequestError for %s", err, endpointSecondsLeft)
+	}
+	if !errors.Is(err, ErrUnmarshalFailed) || errors.Is(err, ErrRequestFailed) {
+		t.Errorf("Got %v, want only ErrUnmarshalFailed", err)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+
+	_, err := s.Messages()
+
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusForbidden {
+		t.Fatalf("Got %v, want StatusError with status 403", err)
+	}
+	if !errors.Is(err, ErrBlockedByServer) || !transient(err) {
+		t.Errorf("Got %v, want transient ErrBlockedByServer", err)
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	err := error(&BatchError{Failures: []BatchFailure{
+		{Index: 0, Key: "abc", Err: ErrExpiredMessage},
+		{Index: 2, Err: ErrBlockedByServer},
+	}})
+
+	if got, want := err.Error(), "2 failed: abc: "+ErrExpiredMessage.Error()+"; #2: "+ErrBlockedByServer.Error(); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+	if !errors.Is(err, ErrExpiredMessage) || !errors.Is(err, ErrBlockedByServer) || errors.Is(err, ErrRequestFailed) {
+		t.Errorf("Got %v, want it to match only the causes", err)
+	}
+}
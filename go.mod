@@ -1,10 +1,23 @@
 module github.com/zhangliwen/tmm
 
-go 1.17
+go 1.21
 
-require github.com/refraction-networking/utls v1.0.0
+require (
+	github.com/prometheus/client_golang v1.19.1
+	github.com/refraction-networking/utls v1.0.0
+	golang.org/x/net v0.20.0
+	golang.org/x/time v0.5.0
+)
 
 require (
-	golang.org/x/crypto v0.0.0-20220313003712-b769efc7c000 // indirect
-	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/crypto v0.18.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
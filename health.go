@@ -0,0 +1,58 @@
+package tmm
+
+import "encoding/json"
+
+// HealthCheck describes the state of a session as seen by the server,
+// in a form suitable for returning from a health check endpoint.
+type HealthCheck struct {
+	// Whether the server answered and the session hasn't expired.
+	Healthy bool
+	// The address of the session.
+	Address string
+	// The number of seconds left before the session expires, as
+	// reported by the server. Zero if the check failed.
+	SecondsLeft int
+	// The error from the check, if any.
+	LastError error
+}
+
+// MarshalJSON writes the health check with the error as a string,
+// or null if there wasn't one.
+func (h HealthCheck) MarshalJSON() ([]byte, error) {
+	var lastError *string
+	if h.LastError != nil {
+		msg := h.LastError.Error()
+		lastError = &msg
+	}
+
+	return json.Marshal(struct {
+		Healthy     bool    `json:"healthy"`
+		Address     string  `json:"address"`
+		SecondsLeft int     `json:"secondsLeft"`
+		LastError   *string `json:"lastError"`
+	}{h.Healthy, h.Address, h.SecondsLeft, lastError})
+}
+
+// HealthChecker is implemented by anything able to report its health,
+// such as a Session.
+type HealthChecker interface {
+	HealthCheck() HealthCheck
+}
+
+// HealthCheck asks the server how long the session has left and
+// reports the result. The session is healthy if the server answered
+// and the session has time left.
+func (s *Session) HealthCheck() HealthCheck {
+	h := HealthCheck{Address: s.Address()}
+
+	secs, err := s.SecondsLeft()
+	if err != nil {
+		h.LastError = err
+		return h
+	}
+
+	h.SecondsLeft = int(secs)
+	h.Healthy = secs > 0
+
+	return h
+}
@@ -0,0 +1,45 @@
+package tmm
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHealthCheck(t *testing.T) {
+	secs := `{"secondsLeft":120}`
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if secs == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(secs))
+	})
+
+	var hc HealthChecker = s
+	h := hc.HealthCheck()
+	if !h.Healthy || h.Address != "test@example.com" || h.SecondsLeft != 120 || h.LastError != nil {
+		t.Errorf("Got %+v, want a healthy session with 120 seconds left", h)
+	}
+
+	secs = `{"secondsLeft":0}`
+	if h := s.HealthCheck(); h.Healthy || h.LastError != nil {
+		t.Errorf("Got %+v for an expired session, want unhealthy without an error", h)
+	}
+
+	secs = ""
+	h = s.HealthCheck()
+	if h.Healthy || h.LastError == nil {
+		t.Errorf("Got %+v for a failed check, want unhealthy with an error", h)
+	}
+
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatalf("unexpected error marshalling health check: %s", err)
+	}
+	var v map[string]any
+	json.Unmarshal(b, &v)
+	if msg, _ := v["lastError"].(string); msg != h.LastError.Error() {
+		t.Errorf("Got %s, want the error as a string", b)
+	}
+}
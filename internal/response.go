@@ -1,9 +1,5 @@
 package internal
 
-type AddressResponse struct {
-	Address string `json:"address"`
-}
-
 type MessageCountResponse struct {
 	MessageCount int64 `json:"messageCount"`
 }
@@ -18,4 +14,5 @@ type ExpiredResponse struct {
 
 type ResetResponse struct {
 	Response string `json:"Response"`
+	Address  string `json:"address,omitempty"`
 }
@@ -0,0 +1,346 @@
+package tmm
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// RelativeLayout can be passed to Message.FormatSentDate to describe
+// the sent date relative to now, such as "2 minutes ago".
+const RelativeLayout = "relative"
+
+// FormatSentDate formats the sent date of the message with layout,
+// as with time.Time.Format, or relative to now if layout is
+// RelativeLayout.
+func (m *Message) FormatSentDate(layout string) string {
+	if layout == RelativeLayout {
+		return relative(time.Since(m.SentDate))
+	}
+
+	return m.SentDate.Format(layout)
+}
+
+// SentDateIn returns the sent date of the message in loc. SentDate
+// keeps the offset given by the server, which is UTC.
+func (m *Message) SentDateIn(loc *time.Location) time.Time {
+	return m.SentDate.In(loc)
+}
+
+// SentDateLocal returns the sent date of the message in the local
+// time zone.
+func (m *Message) SentDateLocal() time.Time {
+	return m.SentDate.Local()
+}
+
+// AsMap returns the fields of the message keyed by their lower case
+// names, for use with text/template or structured logging. The sent
+// date is formatted with time.RFC3339.
+func (m *Message) AsMap() map[string]any {
+	return map[string]any{
+		"id":        m.ID,
+		"sentdate":  m.SentDate.Format(time.RFC3339),
+		"sender":    m.Sender,
+		"subject":   m.Subject,
+		"plaintext": m.Plaintext,
+		"html":      m.HTML,
+		"preview":   m.Preview,
+	}
+}
+
+// ToMap returns the fields of the message keyed by their JSON names,
+// as used by encoding/json. Unlike AsMap, the keys match the names
+// used when the message is serialised. The sent date is formatted
+// with time.RFC3339.
+func (m *Message) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":        m.ID,
+		"sentDate":  m.SentDate.Format(time.RFC3339),
+		"sender":    m.Sender,
+		"subject":   m.Subject,
+		"plaintext": m.Plaintext,
+		"html":      m.HTML,
+		"preview":   m.Preview,
+	}
+}
+
+// relative describes how long ago something happened in words.
+func relative(d time.Duration) string {
+	if d < 0 {
+		return "in the future"
+	}
+
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+		{"second", time.Second},
+	}
+
+	for _, u := range units {
+		n := int64(d / u.size)
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", u.name)
+		}
+		if n > 1 {
+			return fmt.Sprintf("%d %ss ago", n, u.name)
+		}
+	}
+
+	return "just now"
+}
+
+// Match reports whether the subject, plaintext body or text of the
+// HTML body of m contains query, ignoring case.
+func Match(m Message, query string) bool {
+	query = strings.ToLower(query)
+	for _, field := range []string{m.Subject, m.Plaintext, htmlText(m.HTML)} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchError is returned by Message.MatchesRegex when the
+// pattern fails to compile.
+type MatchError struct {
+	Pattern string
+	Err     error
+}
+
+func (e *MatchError) Error() string {
+	return fmt.Sprintf("bad pattern %q: %s", e.Pattern, e.Err)
+}
+
+func (e *MatchError) Unwrap() error {
+	return e.Err
+}
+
+// MatchesRegex reports whether the subject or plaintext body of m
+// contains a match for the regular expression pattern. A *MatchError
+// is returned if pattern isn't valid.
+func (m *Message) MatchesRegex(pattern string) (bool, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, &MatchError{Pattern: pattern, Err: err}
+	}
+
+	return re.MatchString(m.Subject) || re.MatchString(m.Plaintext), nil
+}
+
+// ExtractOTP searches the subject and plaintext body of m, in that
+// order, for a one-time passcode made up of exactly digits decimal
+// digits, such as the 6 digit codes sent to verify a sign up. Longer
+// runs of digits are ignored. digits defaults to 6 if zero or less.
+func (m *Message) ExtractOTP(digits int) (string, bool) {
+	if digits <= 0 {
+		digits = 6
+	}
+
+	for _, field := range []string{m.Subject, m.Plaintext} {
+		if code, ok := digitRun(field, digits); ok {
+			return code, true
+		}
+	}
+
+	return "", false
+}
+
+// digitRun returns the first run of exactly n ASCII digits in s.
+func digitRun(s string, n int) (string, bool) {
+	for i := 0; i < len(s); {
+		if !isDigit(s[i]) {
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(s) && isDigit(s[j]) {
+			j++
+		}
+		if j-i == n {
+			return s[i:j], true
+		}
+		i = j
+	}
+
+	return "", false
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// WordCount returns the number of words in the plaintext body of the
+// message, separated by any amount of whitespace.
+func (m *Message) WordCount() int {
+	return len(strings.Fields(m.Plaintext))
+}
+
+// htmlText returns the text content of an HTML document,
+// with tags, comments, scripts and styles removed.
+func htmlText(s string) string {
+	var b strings.Builder
+	io.Copy(&b, newHTMLTextReader(strings.NewReader(s)))
+
+	return b.String()
+}
+
+// htmlTextReader streams the text content of an HTML document, as
+// returned by htmlText, parsing the document as it is read.
+type htmlTextReader struct {
+	z    *html.Tokenizer
+	skip int
+	// Text read from the current token but not yet returned.
+	buf []byte
+	err error
+}
+
+func newHTMLTextReader(r io.Reader) *htmlTextReader {
+	return &htmlTextReader{z: html.NewTokenizer(r)}
+}
+
+func (r *htmlTextReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		switch r.z.Next() {
+		case html.ErrorToken:
+			r.err = r.z.Err()
+		case html.StartTagToken:
+			if name, _ := r.z.TagName(); isHiddenTag(name) {
+				r.skip++
+			}
+		case html.EndTagToken:
+			if name, _ := r.z.TagName(); isHiddenTag(name) && r.skip > 0 {
+				r.skip--
+			}
+		case html.TextToken:
+			if r.skip == 0 {
+				r.buf = r.z.Text()
+			}
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+// Close stops parsing the document. Later reads return io.EOF.
+func (r *htmlTextReader) Close() error {
+	r.buf, r.err = nil, io.EOF
+	return nil
+}
+
+func isHiddenTag(name []byte) bool {
+	return string(name) == "script" || string(name) == "style"
+}
+
+// urlPattern matches http(s) URLs in plain text.
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// Links returns the distinct absolute URLs linked to from the message,
+// in the order they appear. They're taken from the links in the HTML
+// body, or found in the plaintext body if there's no HTML.
+func (m *Message) Links() []string {
+	var links []string
+	if m.HTML != "" {
+		links = htmlLinks(m.HTML)
+	} else {
+		links = textLinks(m.Plaintext)
+	}
+
+	var abs []string
+	for _, link := range links {
+		if u, err := url.Parse(link); err == nil && u.IsAbs() && u.Host != "" {
+			abs = append(abs, link)
+		}
+	}
+
+	return abs
+}
+
+// ExtractLinks returns the distinct link targets in the message, in the
+// order they appear. They're taken from the links in the HTML body, or
+// found in the plaintext body if there's no HTML.
+//
+// Unlike Links, the targets are returned as written, including relative
+// links and other schemes such as mailto.
+func (m *Message) ExtractLinks() []string {
+	if m.HTML != "" {
+		return htmlLinks(m.HTML)
+	}
+
+	return textLinks(m.Plaintext)
+}
+
+// LinksContaining returns the links from Links which contain substr,
+// such as the confirmation link in a sign up email.
+func (m *Message) LinksContaining(substr string) []string {
+	var found []string
+	for _, link := range m.Links() {
+		if strings.Contains(link, substr) {
+			found = append(found, link)
+		}
+	}
+
+	return found
+}
+
+// htmlLinks returns the distinct link targets in an HTML document.
+func htmlLinks(s string) []string {
+	var links []string
+	seen := make(map[string]bool)
+	z := html.NewTokenizer(strings.NewReader(s))
+
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, more := z.TagName()
+			if string(name) != "a" && string(name) != "area" {
+				continue
+			}
+			for more {
+				var key, val []byte
+				key, val, more = z.TagAttr()
+				href := strings.TrimSpace(string(val))
+				if string(key) == "href" && href != "" && !seen[href] {
+					seen[href] = true
+					links = append(links, href)
+				}
+			}
+		}
+	}
+}
+
+// textLinks returns the distinct URLs in plain text.
+func textLinks(s string) []string {
+	var links []string
+	seen := make(map[string]bool)
+	for _, link := range urlPattern.FindAllString(s, -1) {
+		// Don't include punctuation ending the sentence
+		link = strings.TrimRight(link, ".,;:!?)]")
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+
+	return links
+}
@@ -0,0 +1,246 @@
+package tmm
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelative(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{-time.Minute, "in the future"},
+		{500 * time.Millisecond, "just now"},
+		{time.Second, "1 second ago"},
+		{2*time.Minute + 10*time.Second, "2 minutes ago"},
+		{time.Hour, "1 hour ago"},
+		{50 * time.Hour, "2 days ago"},
+	}
+
+	for _, tt := range tests {
+		if got := relative(tt.d); got != tt.want {
+			t.Errorf("%s: Got %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestFormatSentDate(t *testing.T) {
+	m := Message{SentDate: time.Date(2021, 11, 28, 8, 21, 6, 0, time.UTC)}
+
+	if got := m.FormatSentDate(time.RFC1123); got != "Sun, 28 Nov 2021 08:21:06 UTC" {
+		t.Errorf("Got %q", got)
+	}
+
+	m.SentDate = time.Now().Add(-3 * time.Minute)
+	if got := m.FormatSentDate(RelativeLayout); got != "3 minutes ago" {
+		t.Errorf("Got %q, want \"3 minutes ago\"", got)
+	}
+}
+
+func TestSentDateIn(t *testing.T) {
+	var m Message
+	if err := json.Unmarshal([]byte(ExampleMessage), &m); err != nil {
+		t.Fatalf("failed to unmarshal message: %s", err)
+	}
+
+	loc := time.FixedZone("AEDT", 11*60*60)
+	got := m.SentDateIn(loc)
+	if got.Location() != loc || got.Hour() != 19 || got.Minute() != 21 {
+		t.Errorf("Got %s, want 19:21 AEDT", got)
+	}
+	if !got.Equal(m.SentDate) {
+		t.Errorf("Got %s, want the same instant as %s", got, m.SentDate)
+	}
+
+	if got := m.SentDateLocal(); got.Location() != time.Local || !got.Equal(m.SentDate) {
+		t.Errorf("Got %s, want %s in the local zone", got, m.SentDate)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	m := Message{
+		Subject:   "Welcome",
+		Plaintext: "Thanks for signing up",
+		HTML:      `<p class="confirm">Click to <b>Confirm</b> your account</p><style>.secret{}</style>`,
+	}
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"welcome", true},
+		{"SIGNING", true},
+		{"confirm your account", true},
+		{"class", false},
+		{"secret", false},
+		{"goodbye", false},
+	}
+
+	for _, tt := range tests {
+		if got := Match(m, tt.query); got != tt.want {
+			t.Errorf("%q: Got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesRegex(t *testing.T) {
+	m := Message{Subject: "Your code", Plaintext: "Use 123456 to log in"}
+
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{`\d{6}`, true},
+		{`^Your`, true},
+		{`\d{7}`, false},
+	}
+
+	for _, tt := range tests {
+		got, err := m.MatchesRegex(tt.pattern)
+		if err != nil || got != tt.want {
+			t.Errorf("%q: Got %v, %v, want %v", tt.pattern, got, err, tt.want)
+		}
+	}
+
+	var merr *MatchError
+	if _, err := m.MatchesRegex(`(`); !errors.As(err, &merr) || merr.Pattern != "(" {
+		t.Errorf("Got %v, want MatchError for bad pattern", err)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Message
+		want []string
+	}{
+		{
+			"html",
+			Message{
+				HTML:      `<a href="https://example.com/confirm?t=1">Confirm</a> <a href="/relative">x</a> <a href="https://example.com/confirm?t=1">again</a> <a href="mailto:a@example.com">mail</a>`,
+				Plaintext: "https://ignored.example.com",
+			},
+			[]string{"https://example.com/confirm?t=1"},
+		},
+		{
+			"plaintext",
+			Message{Plaintext: "Visit https://example.com/a. Or (http://example.org/b)!"},
+			[]string{"https://example.com/a", "http://example.org/b"},
+		},
+		{
+			"none",
+			Message{Plaintext: "no links here"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.m.Links()
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("Got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinksContaining(t *testing.T) {
+	m := Message{HTML: `<a href="https://example.com/unsubscribe">u</a><a href="https://example.com/confirm/abc">c</a>`}
+
+	got := m.LinksContaining("confirm")
+	if len(got) != 1 || got[0] != "https://example.com/confirm/abc" {
+		t.Errorf("Got %q, want the confirm link", got)
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	m := Message{HTML: `<a href="https://example.com/a">a</a><a href="/b">b</a><a href="https://example.com/a">again</a>`}
+
+	got := m.ExtractLinks()
+	if strings.Join(got, " ") != "https://example.com/a /b" {
+		t.Errorf("Got %q, want both distinct links", got)
+	}
+
+	m = Message{Plaintext: "Go to https://example.com/c."}
+	if got := m.ExtractLinks(); len(got) != 1 || got[0] != "https://example.com/c" {
+		t.Errorf("Got %q, want the plaintext link", got)
+	}
+}
+
+func TestExtractOTP(t *testing.T) {
+	tests := []struct {
+		m      Message
+		digits int
+		want   string
+	}{
+		{Message{Subject: "Your code is 123456"}, 0, "123456"},
+		{Message{Subject: "Welcome", Plaintext: "Order 12345678, code: 4821."}, 4, "4821"},
+		{Message{Plaintext: "Call 0123456789"}, 6, ""},
+		{Message{Subject: "Code 1234", Plaintext: "Or use 987654"}, 6, "987654"},
+		{Message{Plaintext: "Code 123456"}, 5000, ""},
+		{Message{Plaintext: "x" + strings.Repeat("7", 1001) + "."}, 1001, strings.Repeat("7", 1001)},
+	}
+
+	for _, tt := range tests {
+		got, ok := tt.m.ExtractOTP(tt.digits)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("%+v: Got %q, %v, want %q", tt.m, got, ok, tt.want)
+		}
+	}
+}
+
+func TestAsMap(t *testing.T) {
+	m := Message{
+		ID:       "1",
+		SentDate: time.Date(2021, 11, 28, 8, 21, 6, 0, time.UTC),
+		Subject:  "Testing",
+		Preview:  "hello",
+	}
+
+	got := m.AsMap()
+	if got["id"] != "1" || got["subject"] != "Testing" || got["preview"] != "hello" {
+		t.Errorf("Got %v, want the message fields", got)
+	}
+	if got["sentdate"] != "2021-11-28T08:21:06Z" {
+		t.Errorf("Got sent date %v, want 2021-11-28T08:21:06Z", got["sentdate"])
+	}
+}
+
+func TestToMap(t *testing.T) {
+	m := Message{
+		ID:       "1",
+		SentDate: time.Date(2021, 11, 28, 8, 21, 6, 0, time.UTC),
+		HTML:     "<p>hi</p>",
+	}
+
+	got := m.ToMap()
+	if got["id"] != "1" || got["html"] != "<p>hi</p>" {
+		t.Errorf("Got %v, want the message fields", got)
+	}
+	if got["sentDate"] != "2021-11-28T08:21:06Z" {
+		t.Errorf("Got sent date %v, want 2021-11-28T08:21:06Z", got["sentDate"])
+	}
+}
+
+func TestWordCount(t *testing.T) {
+	tests := []struct {
+		plaintext string
+		want      int
+	}{
+		{"", 0},
+		{"  \n\t ", 0},
+		{"hello world", 2},
+		{" Thanks,\n\n  the\tteam ", 3},
+	}
+
+	for _, tt := range tests {
+		m := Message{Plaintext: tt.plaintext}
+		if got := m.WordCount(); got != tt.want {
+			t.Errorf("%q: Got %d, want %d", tt.plaintext, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package tmm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the Prometheus collectors updated by each request.
+type metrics struct {
+	latency   *prometheus.HistogramVec
+	succeeded *prometheus.CounterVec
+	failed    *prometheus.CounterVec
+}
+
+// WithPrometheusMetrics records the latency and outcome of each request
+// made by the session, labelled by endpoint, in collectors registered
+// with reg. Requests fail if they error or the server responds with
+// an error status.
+//
+// Sessions registering with the same reg share the same collectors.
+func WithPrometheusMetrics(reg prometheus.Registerer) Option {
+	return func(c *config) error {
+		latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "tmm_request_duration_seconds",
+			Help: "Latency of requests to 10MinuteMail.",
+		}, []string{"endpoint"})
+		succeeded := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tmm_requests_succeeded_total",
+			Help: "Number of successful requests to 10MinuteMail.",
+		}, []string{"endpoint"})
+		failed := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tmm_requests_failed_total",
+			Help: "Number of failed requests to 10MinuteMail.",
+		}, []string{"endpoint"})
+
+		m := &metrics{}
+		var err error
+		if m.latency, err = register(reg, latency); err != nil {
+			return err
+		}
+		if m.succeeded, err = register(reg, succeeded); err != nil {
+			return err
+		}
+		if m.failed, err = register(reg, failed); err != nil {
+			return err
+		}
+
+		c.metrics = m
+		return nil
+	}
+}
+
+// register registers c with reg, returning the collector that's
+// already registered in its place if there is one.
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) (C, error) {
+	err := reg.Register(c)
+	if err == nil {
+		return c, nil
+	}
+
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(C); ok {
+			return existing, nil
+		}
+	}
+
+	return c, fmt.Errorf("%w: registering metrics: %w", ErrInvalidOption, err)
+}
+
+// observe records the outcome of a request made to endpoint.
+func (m *metrics) observe(endpoint string, res *http.Response, err error, d time.Duration) {
+	m.latency.WithLabelValues(endpoint).Observe(d.Seconds())
+
+	if err != nil || res.StatusCode >= http.StatusBadRequest {
+		m.failed.WithLabelValues(endpoint).Inc()
+	} else {
+		m.succeeded.WithLabelValues(endpoint).Inc()
+	}
+}
@@ -0,0 +1,36 @@
+package tmm
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	h := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}
+	s := newTestSession(t, h, WithPrometheusMetrics(reg))
+
+	// A second session shares the already registered collectors
+	other := newTestSession(t, h, WithPrometheusMetrics(reg))
+
+	for _, sess := range []*Session{s, other} {
+		if _, err := sess.Latest(); err != nil {
+			t.Fatalf("unexpected error fetching messages: %s", err)
+		}
+	}
+
+	succeeded := s.cfg.metrics.succeeded.WithLabelValues(endpointMessagesAfter)
+	if got := testutil.ToFloat64(succeeded); got != 2 {
+		t.Errorf("Got %v successful requests, want 2", got)
+	}
+
+	if n := testutil.CollectAndCount(s.cfg.metrics.latency); n != 2 {
+		t.Errorf("Got %d latency series, want 2", n)
+	}
+}
@@ -0,0 +1,184 @@
+package tmm
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// MIMEBody holds the parts of a MIME payload found by Message.ParseMIME.
+type MIMEBody struct {
+	// The headers of the outermost entity. Empty if the payload
+	// started straight away with a multipart boundary.
+	Header textproto.MIMEHeader
+	// The decoded plain text and HTML alternatives, empty if the
+	// payload didn't have one.
+	Plaintext string
+	HTML      string
+}
+
+// ParseMIME parses the HTML body of the message as a MIME payload,
+// which some senders put there in place of the HTML itself, and
+// returns the text and HTML alternatives it contains. Quoted-printable
+// and base64 parts are decoded, and attachments are skipped.
+//
+// ErrInvalidMIME is returned if the body isn't a MIME payload.
+func (m *Message) ParseMIME() (*MIMEBody, error) {
+	b := &MIMEBody{Header: textproto.MIMEHeader{}}
+	payload := strings.TrimLeft(m.HTML, " \t\r\n")
+
+	// Some senders leave out the headers and start with the boundary
+	if strings.HasPrefix(payload, "--") {
+		line, _, _ := strings.Cut(payload, "\n")
+		if err := b.walkMultipart(strings.NewReader(payload), strings.TrimSpace(line[2:])); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(payload))
+	if err != nil || msg.Header.Get("Content-Type") == "" {
+		return nil, ErrInvalidMIME
+	}
+
+	b.Header = textproto.MIMEHeader(msg.Header)
+	if err := b.walk(b.Header, msg.Body); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// walk records the text alternatives in the entity with header h
+// and body r, descending into multipart entities.
+func (b *MIMEBody) walk(h textproto.MIMEHeader, r io.Reader) error {
+	mediatype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		// The default for entities without a usable type
+		mediatype = "text/plain"
+	}
+
+	if strings.HasPrefix(mediatype, "multipart/") {
+		return b.walkMultipart(r, params["boundary"])
+	}
+
+	if d, _, _ := mime.ParseMediaType(h.Get("Content-Disposition")); d == "attachment" {
+		return nil
+	}
+	if mediatype != "text/plain" && mediatype != "text/html" {
+		return nil
+	}
+
+	data, err := io.ReadAll(decodeTransfer(h, r))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMIME, err)
+	}
+
+	if mediatype == "text/plain" && b.Plaintext == "" {
+		b.Plaintext = string(data)
+	}
+	if mediatype == "text/html" && b.HTML == "" {
+		b.HTML = string(data)
+	}
+
+	return nil
+}
+
+// walkMultipart walks each part of a multipart body.
+func (b *MIMEBody) walkMultipart(r io.Reader, boundary string) error {
+	if boundary == "" {
+		return fmt.Errorf("%w: multipart without boundary", ErrInvalidMIME)
+	}
+
+	mr := multipart.NewReader(r, boundary)
+	for {
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidMIME, err)
+		}
+
+		if err := b.walk(p.Header, p); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeTransfer undoes the content transfer encoding of a body.
+// Quoted-printable parts of a multipart body have already been
+// decoded by the multipart reader, which removes the header.
+func decodeTransfer(h textproto.MIMEHeader, r io.Reader) io.Reader {
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+
+	return r
+}
+
+// AuthResults returns the results of the email authentication checks
+// recorded in the headers of the message, keyed by lower case method
+// such as "spf", "dkim" and "dmarc". They're read from any
+// Authentication-Results headers, falling back to Received-SPF for
+// "spf". Only the first result for each method is kept.
+//
+// The headers are only available when the HTML body holds the MIME
+// source of the message, as for ParseMIME. An empty map is returned
+// if it doesn't.
+func (m *Message) AuthResults() (map[string]string, error) {
+	results := make(map[string]string)
+
+	b, err := m.ParseMIME()
+	if errors.Is(err, ErrInvalidMIME) {
+		return results, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range b.Header.Values("Authentication-Results") {
+		parseAuthResults(v, results)
+	}
+	if _, ok := results["spf"]; !ok {
+		if f := strings.Fields(b.Header.Get("Received-SPF")); len(f) > 0 {
+			results["spf"] = strings.ToLower(f[0])
+		}
+	}
+
+	return results, nil
+}
+
+// parseAuthResults adds the results in an Authentication-Results
+// header value, as described in RFC 8601, to results.
+func parseAuthResults(v string, results map[string]string) {
+	// The first element identifies the server which did the checks
+	_, rest, ok := strings.Cut(v, ";")
+	if !ok {
+		return
+	}
+
+	for _, part := range strings.Split(rest, ";") {
+		method, result, ok := strings.Cut(part, "=")
+		f := strings.Fields(result)
+		if !ok || len(f) == 0 {
+			continue
+		}
+
+		// Drop any version, as in "dkim/1"
+		method, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(method)), "/")
+		if _, seen := results[method]; !seen && method != "" {
+			results[method] = strings.ToLower(f[0])
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package tmm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseMIME(t *testing.T) {
+	eml, err := (&Message{Plaintext: "héllo = world", HTML: "<p>héllo</p>"}).EML()
+	if err != nil {
+		t.Fatalf("unexpected error building eml: %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		payload   string
+		plaintext string
+		html      string
+	}{
+		{"quoted-printable", string(eml), "héllo = world", "<p>héllo</p>"},
+		{
+			"base64 with attachment",
+			"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+				"--outer\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\naGVs\r\nbG8=\r\n" +
+				"--outer\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=a.txt\r\n\r\nignored\r\n" +
+				"--outer--\r\n",
+			"hello",
+			"",
+		},
+		{
+			"no headers",
+			"--b\r\nContent-Type: text/html\r\n\r\n<b>hi</b>\r\n--b--\r\n",
+			"",
+			"<b>hi</b>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Message{HTML: tt.payload}
+			b, err := m.ParseMIME()
+			if err != nil {
+				t.Fatalf("unexpected error parsing: %s", err)
+			}
+			if b.Plaintext != tt.plaintext || b.HTML != tt.html {
+				t.Errorf("Got %q and %q, want %q and %q", b.Plaintext, b.HTML, tt.plaintext, tt.html)
+			}
+		})
+	}
+
+	m := Message{HTML: "<div>just html</div>"}
+	if _, err := m.ParseMIME(); !errors.Is(err, ErrInvalidMIME) {
+		t.Errorf("Got %v, want ErrInvalidMIME", err)
+	}
+}
+
+func TestAuthResults(t *testing.T) {
+	source := "Authentication-Results: mx.example.com;\r\n" +
+		" spf=pass (sender allowed) smtp.mailfrom=a@example.org;\r\n" +
+		" dkim=FAIL header.d=example.org; dmarc=none\r\n" +
+		"Authentication-Results: other.example.com; dkim=pass\r\n" +
+		"Received-SPF: softfail (not used)\r\n" +
+		"Content-Type: text/plain\r\n\r\nhi\r\n"
+
+	m := Message{HTML: source}
+	got, err := m.AuthResults()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[string]string{"spf": "pass", "dkim": "fail", "dmarc": "none"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+
+	m = Message{HTML: "Received-SPF: Pass (ok)\r\nContent-Type: text/plain\r\n\r\nhi\r\n"}
+	if got, _ := m.AuthResults(); got["spf"] != "pass" || len(got) != 1 {
+		t.Errorf("Got %v, want spf from Received-SPF", got)
+	}
+
+	m = Message{HTML: "<div>just html</div>"}
+	if got, err := m.AuthResults(); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("Got %v and %v, want an empty map", got, err)
+	}
+}
@@ -0,0 +1,586 @@
+package tmm
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/time/rate"
+)
+
+// Option configures a Session at construction time.
+type Option func(*config) error
+
+// config holds the settings applied by a set of Options.
+type config struct {
+	userAgent string
+	locale    string
+	referer   string
+	timeout   time.Duration
+	baseURL   string
+	proxy     *url.URL
+	pins      map[string]bool
+	http2     bool
+
+	// TLS versions and cipher suites offered in place of those in the
+	// fingerprint, if set.
+	tlsMin, tlsMax      uint16
+	cipherSuites        []uint16
+	standardTLSFallback bool
+
+	// Trusted roots for the server certificate. Only set in tests;
+	// nil means the system pool.
+	rootCAs *x509.CertPool
+	// Tickets for resuming TLS sessions, shared by the connections
+	// of one transport. Set when the transport is built.
+	sessionCache tls.ClientSessionCache
+
+	transport           http.RoundTripper
+	localAddr           *net.TCPAddr
+	dialTimeout         time.Duration
+	tlsHandshakeTimeout time.Duration
+	maxIdleConns        int
+	idleConnTimeout     time.Duration
+
+	maxBodySize  int64
+	initRetries  int
+	maxMessages  int
+	cookieMaxAge int
+
+	expiryGuard  bool
+	dedup        bool
+	strict       bool
+	sendFailFast bool
+	watchBackoff *backoff
+	watchBuffer  int
+	watchDrop    DropPolicy
+
+	logger      *slog.Logger
+	limiter     *rate.Limiter
+	sendLimiter *sendLimiter
+	metrics     *metrics
+	trace       func(RequestTrace)
+
+	onAddressChange func(old, new string)
+}
+
+// defaultConfig returns the settings used when no Options are given.
+func defaultConfig() config {
+	return config{
+		userAgent: DefaultUserAgent,
+		locale:    DefaultLocale,
+		timeout:   DefaultTimeout,
+		baseURL:   baseURL,
+
+		maxBodySize:  defaultMaxBodySize,
+		cookieMaxAge: 300,
+		expiryGuard:  true,
+	}
+}
+
+// newConfig applies opts on top of the default settings and checks
+// the result for conflicting options.
+func newConfig(opts []Option) (config, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+// validate checks for combinations of options that can't work together.
+func (c *config) validate() error {
+	if c.proxy != nil && !strings.HasPrefix(c.baseURL, "https:") {
+		return fmt.Errorf("%w: proxy is only used for https base urls", ErrInvalidOption)
+	}
+	if c.watchDrop != DropNone && c.watchBuffer == 0 {
+		return fmt.Errorf("%w: watch drop policy needs a buffer", ErrInvalidOption)
+	}
+	if c.transport != nil && c.configuresTransport() {
+		return fmt.Errorf("%w: transport options can't be used with WithTransport", ErrInvalidOption)
+	}
+
+	return nil
+}
+
+// configuresTransport reports whether any options that only apply to
+// the transport built by New have been set.
+func (c *config) configuresTransport() bool {
+	return c.proxy != nil || c.pins != nil || c.http2 ||
+		c.tlsMax != 0 || c.cipherSuites != nil || c.standardTLSFallback ||
+		c.localAddr != nil || c.dialTimeout != 0 || c.tlsHandshakeTimeout != 0 ||
+		c.maxIdleConns != 0 || c.idleConnTimeout != 0
+}
+
+// Validate reports whether opts are valid and can be used together,
+// without creating a session or making any requests. The constructors
+// perform the same checks.
+func Validate(opts ...Option) error {
+	_, err := newConfig(opts)
+	return err
+}
+
+// WithUserAgent overrides the User-Agent header sent with every request.
+func WithUserAgent(ua string) Option {
+	return func(c *config) error {
+		if ua == "" {
+			return fmt.Errorf("%w: empty user agent", ErrInvalidOption)
+		}
+		c.userAgent = ua
+		return nil
+	}
+}
+
+// WithLocale overrides the Accept-Language header sent with every
+// request, such as "de-DE,de;q=0.9". By default it is DefaultLocale,
+// as sent by a typical browser.
+func WithLocale(lang string) Option {
+	return func(c *config) error {
+		if lang == "" {
+			return fmt.Errorf("%w: empty locale", ErrInvalidOption)
+		}
+		c.locale = lang
+		return nil
+	}
+}
+
+// WithReferer overrides the Referer header sent with every request to
+// the server. By default it is the home page of the server, as sent
+// by a browser using the site.
+func WithReferer(rawurl string) Option {
+	return func(c *config) error {
+		u, err := url.Parse(rawurl)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("%w: bad referer %q", ErrInvalidOption, rawurl)
+		}
+		c.referer = rawurl
+		return nil
+	}
+}
+
+// WithTimeout overrides the overall HTTP client timeout.
+// It has no effect when used with NewWithClient.
+func WithTimeout(d time.Duration) Option {
+	return func(c *config) error {
+		if d < 0 {
+			return fmt.Errorf("%w: negative timeout %s", ErrInvalidOption, d)
+		}
+		c.timeout = d
+		return nil
+	}
+}
+
+// WithBaseURL points the session at a different 10MinuteMail
+// compatible server. Mostly useful for testing.
+func WithBaseURL(rawurl string) Option {
+	return func(c *config) error {
+		u, err := url.Parse(rawurl)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%w: bad base url %q", ErrInvalidOption, rawurl)
+		}
+		c.baseURL = rawurl
+		return nil
+	}
+}
+
+// WithProxy routes all requests through the HTTP proxy at rawurl.
+// The TLS handshake is tunnelled through the proxy with CONNECT
+// so the custom ClientHello is preserved.
+// It has no effect when used with NewWithClient.
+func WithProxy(rawurl string) Option {
+	return func(c *config) error {
+		u, err := url.Parse(rawurl)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%w: bad proxy url %q", ErrInvalidOption, rawurl)
+		}
+		if u.Scheme != "http" {
+			return fmt.Errorf("%w: unsupported proxy scheme %q", ErrInvalidOption, u.Scheme)
+		}
+		c.proxy = u
+		return nil
+	}
+}
+
+// WithCertPin only allows TLS connections to servers whose certificate
+// chain contains a public key matching one of pins. Each pin is the
+// base64 encoded SHA-256 hash of a DER encoded SubjectPublicKeyInfo,
+// as used by HPKP. Connections that don't match fail with
+// ErrCertPinMismatch.
+// It has no effect when used with NewWithClient.
+func WithCertPin(pins ...string) Option {
+	return func(c *config) error {
+		if len(pins) == 0 {
+			return fmt.Errorf("%w: no certificate pins given", ErrInvalidOption)
+		}
+		if c.pins == nil {
+			c.pins = make(map[string]bool)
+		}
+		for _, pin := range pins {
+			b, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("%w: bad certificate pin %q", ErrInvalidOption, pin)
+			}
+			c.pins[pin] = true
+		}
+		return nil
+	}
+}
+
+// WithHTTP2 offers HTTP/2 to the server during the TLS handshake and
+// uses it for requests if the server accepts, falling back to HTTP/1.1
+// if it doesn't. Note that this changes the TLS fingerprint.
+// It has no effect when used with NewWithClient.
+func WithHTTP2() Option {
+	return func(c *config) error {
+		c.http2 = true
+		return nil
+	}
+}
+
+// WithTLSVersions changes the range of TLS versions offered to the
+// server, tls.VersionTLS10 to tls.VersionTLS12 by default, keeping the
+// rest of the fingerprint. Offering tls.VersionTLS13 adds the extensions
+// and cipher suites it needs. Connections which don't negotiate at least
+// min fail.
+// It has no effect when used with NewWithClient.
+func WithTLSVersions(min, max uint16) Option {
+	return func(c *config) error {
+		for _, v := range []uint16{min, max} {
+			if v < tls.VersionTLS10 || v > tls.VersionTLS13 {
+				return fmt.Errorf("%w: unsupported TLS version %#x", ErrInvalidOption, v)
+			}
+		}
+		if min > max {
+			return fmt.Errorf("%w: TLS version range %#x-%#x is empty", ErrInvalidOption, min, max)
+		}
+		c.tlsMin, c.tlsMax = min, max
+		return nil
+	}
+}
+
+// WithCipherSuites replaces the cipher suites offered to the server,
+// in order of preference, keeping the rest of the fingerprint. When
+// offering TLS 1.3 with WithTLSVersions, the TLS 1.3 suites must be
+// included as they aren't added to the list given.
+// It has no effect when used with NewWithClient.
+func WithCipherSuites(ids ...uint16) Option {
+	return func(c *config) error {
+		if len(ids) == 0 {
+			return fmt.Errorf("%w: no cipher suites given", ErrInvalidOption)
+		}
+		c.cipherSuites = ids
+		return nil
+	}
+}
+
+// WithStandardTLSFallback makes connections fall back to a standard
+// crypto/tls handshake if the handshake with the custom ClientHello
+// fails twice in a row. This keeps things working on networks that
+// interfere with the custom handshake, at the cost of a fingerprint
+// which Cloudflare may block.
+// It has no effect when used with NewWithClient.
+func WithStandardTLSFallback() Option {
+	return func(c *config) error {
+		c.standardTLSFallback = true
+		return nil
+	}
+}
+
+// WithTransport makes the session send requests with t rather than
+// building its own transport, so that many sessions can share one
+// connection pool. Use NewTransport to build a transport that keeps
+// the custom TLS fingerprint. It can't be combined with options that
+// configure the transport, which should be passed to NewTransport
+// instead.
+// It has no effect when used with NewWithClient.
+func WithTransport(t http.RoundTripper) Option {
+	return func(c *config) error {
+		if t == nil {
+			return fmt.Errorf("%w: nil transport", ErrInvalidOption)
+		}
+		c.transport = t
+		return nil
+	}
+}
+
+// WithLocalAddr makes connections to the server, or to the proxy if
+// one is configured, from the local address addr, such as to use a
+// particular network interface on a host with several. addr is an IP
+// address, optionally with a port as "host:port".
+// It has no effect when used with NewWithClient.
+func WithLocalAddr(addr string) Option {
+	return func(c *config) error {
+		if ip := net.ParseIP(addr); ip != nil {
+			c.localAddr = &net.TCPAddr{IP: ip}
+			return nil
+		}
+
+		a, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("%w: bad local address %q: %w", ErrInvalidOption, addr, err)
+		}
+		c.localAddr = a
+		return nil
+	}
+}
+
+// WithDialTimeout limits how long connecting to the server, or to the
+// proxy if one is configured, may take. This is separate from, and
+// usually shorter than, the overall request timeout. Zero means no
+// limit beyond the request timeout.
+// It has no effect when used with NewWithClient.
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *config) error {
+		if d < 0 {
+			return fmt.Errorf("%w: negative dial timeout %s", ErrInvalidOption, d)
+		}
+		c.dialTimeout = d
+		return nil
+	}
+}
+
+// WithTLSHandshakeTimeout limits how long the TLS handshake with the
+// server may take once connected. Like WithDialTimeout, it lets slow
+// networks be given more time to connect without relaxing the overall
+// request timeout. Zero means no limit beyond the request timeout.
+// It has no effect when used with NewWithClient.
+func WithTLSHandshakeTimeout(d time.Duration) Option {
+	return func(c *config) error {
+		if d < 0 {
+			return fmt.Errorf("%w: negative TLS handshake timeout %s", ErrInvalidOption, d)
+		}
+		c.tlsHandshakeTimeout = d
+		return nil
+	}
+}
+
+// WithMaxIdleConns limits the number of idle connections kept open
+// by the session's transport. Zero means no limit.
+// It has no effect when used with NewWithClient.
+func WithMaxIdleConns(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("%w: negative idle connection limit %d", ErrInvalidOption, n)
+		}
+		c.maxIdleConns = n
+		return nil
+	}
+}
+
+// WithIdleConnTimeout sets how long an idle connection is kept open
+// by the session's transport before being closed. Zero means no limit.
+// It has no effect when used with NewWithClient.
+func WithIdleConnTimeout(d time.Duration) Option {
+	return func(c *config) error {
+		if d < 0 {
+			return fmt.Errorf("%w: negative idle timeout %s", ErrInvalidOption, d)
+		}
+		c.idleConnTimeout = d
+		return nil
+	}
+}
+
+// WithMaxBodySize limits the size of response bodies read from the
+// server to n bytes, protecting against a broken or malicious server
+// exhausting memory. Larger responses fail with ErrBodyTooLarge. The
+// default is 4MiB.
+func WithMaxBodySize(n int64) Option {
+	return func(c *config) error {
+		if n <= 0 {
+			return fmt.Errorf("%w: body size limit must be positive", ErrInvalidOption)
+		}
+		c.maxBodySize = n
+		return nil
+	}
+}
+
+// WithMaxMessageCount limits the number of messages returned by each
+// call to Messages, Latest and the methods built on them to n. If the
+// server returns more, the n most recently sent are kept.
+func WithMaxMessageCount(n int) Option {
+	return func(c *config) error {
+		if n <= 0 {
+			return fmt.Errorf("%w: message count limit must be positive", ErrInvalidOption)
+		}
+		c.maxMessages = n
+		return nil
+	}
+}
+
+// WithInitRetries makes creating a session retry up to n times if the
+// server responds without a session cookie or address, which can
+// happen when it's under heavy load. Other failures aren't retried.
+func WithInitRetries(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("%w: negative retry count %d", ErrInvalidOption, n)
+		}
+		c.initRetries = n
+		return nil
+	}
+}
+
+// WithCookieMaxAge sets the MaxAge, in seconds, of the JSESSIONID
+// cookie made by the session, including the one returned by
+// ExportCookies for sessions whose cookie wasn't sent by the server.
+// The default of 300 suits a session that is about to expire; raise
+// it if the session will be renewed and handed off to a browser.
+func WithCookieMaxAge(seconds int) Option {
+	return func(c *config) error {
+		if seconds <= 0 {
+			return fmt.Errorf("%w: cookie max age must be positive", ErrInvalidOption)
+		}
+		c.cookieMaxAge = seconds
+		return nil
+	}
+}
+
+// WithExpiryGuard controls whether methods check that the session
+// hasn't expired before contacting the server, returning
+// ErrSessionExpired if it has. Enabled by default; disable it to
+// make the request regardless.
+func WithExpiryGuard(enabled bool) Option {
+	return func(c *config) error {
+		c.expiryGuard = enabled
+		return nil
+	}
+}
+
+// WithDedup makes Latest, TryLatest and anything built on them, such as
+// Watch, skip messages they have already returned. This protects against
+// the server returning a message twice if the message counter gets out
+// of sync, for example after an error part way through a fetch.
+//
+// The most recent 1000 message IDs are remembered.
+func WithDedup() Option {
+	return func(c *config) error {
+		c.dedup = true
+		return nil
+	}
+}
+
+// WithStrictMode makes Reply and Forward return an error rather than
+// just false when the server doesn't accept the request. Messages the
+// server refuses as too old fail with ErrExpiredMessage, and any other
+// unexpected status with ErrRequestFailed.
+func WithStrictMode() Option {
+	return func(c *config) error {
+		c.strict = true
+		return nil
+	}
+}
+
+// WithWatchBackoff makes Watch back off exponentially when polling
+// fails. After the first consecutive error the watcher waits min, and
+// each further error multiplies the wait by factor, up to max. The
+// original interval is restored after the next successful poll.
+func WithWatchBackoff(min, max time.Duration, factor float64) Option {
+	return func(c *config) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("%w: bad back-off range %s-%s", ErrInvalidOption, min, max)
+		}
+		if factor < 1 {
+			return fmt.Errorf("%w: back-off factor %g is less than 1", ErrInvalidOption, factor)
+		}
+		c.watchBackoff = &backoff{min: min, max: max, factor: factor}
+		return nil
+	}
+}
+
+// WithWatchBufferSize buffers up to n messages on the Messages channel
+// of each watcher, so a slow receiver doesn't hold up polling until
+// the buffer is full. The channel is unbuffered by default.
+func WithWatchBufferSize(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("%w: negative watch buffer size %d", ErrInvalidOption, n)
+		}
+		c.watchBuffer = n
+		return nil
+	}
+}
+
+// WithWatchDropPolicy controls what watchers do with new messages once
+// the buffer set by WithWatchBufferSize is full: wait for the receiver
+// with DropNone, the default, or keep polling and discard messages with
+// DropOldest or DropLatest. Dropping requires a buffer.
+func WithWatchDropPolicy(policy DropPolicy) Option {
+	return func(c *config) error {
+		if policy < DropNone || policy > DropLatest {
+			return fmt.Errorf("%w: unknown drop policy %d", ErrInvalidOption, policy)
+		}
+		c.watchDrop = policy
+		return nil
+	}
+}
+
+// WithLogger logs each request made by the session at debug level,
+// requests the server appears to have blocked or rate limited at
+// warn level, and renewals made by RenewLoop at info level. Nothing
+// is logged by default.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *config) error {
+		c.logger = l
+		return nil
+	}
+}
+
+// WithRateLimit limits the rate of requests made by the session to r
+// per second, allowing bursts of up to burst requests. Requests wait
+// for their turn, failing with ErrRateLimited if the wait would outlast
+// the client timeout.
+func WithRateLimit(r rate.Limit, burst int) Option {
+	return func(c *config) error {
+		if r <= 0 || burst <= 0 {
+			return fmt.Errorf("%w: rate limit must be positive", ErrInvalidOption)
+		}
+		c.limiter = rate.NewLimiter(r, burst)
+		return nil
+	}
+}
+
+// WithSendRate limits replies and forwards to perMinute a minute,
+// spaced evenly, to stay under the server's cap on sending mail. This
+// is separate from WithRateLimit, which applies to every request. Sends
+// wait for their turn, unless WithSendFailFast is given.
+func WithSendRate(perMinute int) Option {
+	return func(c *config) error {
+		if perMinute <= 0 {
+			return fmt.Errorf("%w: send rate must be positive", ErrInvalidOption)
+		}
+		c.sendLimiter = newSendLimiter(perMinute)
+		return nil
+	}
+}
+
+// WithSendFailFast makes replies and forwards fail immediately with
+// ErrSendRateExceeded, rather than wait, when they would exceed the
+// rate set by WithSendRate.
+func WithSendFailFast() Option {
+	return func(c *config) error {
+		c.sendFailFast = true
+		return nil
+	}
+}
+
+// WithAddressChangeHook calls fn whenever the server reports a
+// different address for the session than the one it had, such as
+// when renewing. The session switches to the new address before fn
+// is called, so mail sent to the old one may never arrive.
+func WithAddressChangeHook(fn func(old, new string)) Option {
+	return func(c *config) error {
+		c.onAddressChange = fn
+		return nil
+	}
+}
@@ -0,0 +1,123 @@
+package tmm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdleConnOptions(t *testing.T) {
+	cfg, err := newConfig([]Option{
+		WithMaxIdleConns(50),
+		WithIdleConnTimeout(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error applying options: %s", err)
+	}
+
+	tr := newTransport(cfg).(*http.Transport)
+	if tr.MaxIdleConns != 50 {
+		t.Errorf("Got MaxIdleConns %d, want 50", tr.MaxIdleConns)
+	}
+	if tr.IdleConnTimeout != time.Minute {
+		t.Errorf("Got IdleConnTimeout %s, want 1m", tr.IdleConnTimeout)
+	}
+}
+
+func TestIdleConnOptionsIgnoredWithClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+		w.Write([]byte(`{"address":"test@example.com"}`))
+	}))
+	defer srv.Close()
+
+	tr := &http.Transport{}
+	_, err := NewWithClient(&http.Client{Transport: tr},
+		WithBaseURL(srv.URL),
+		WithMaxIdleConns(50),
+		WithIdleConnTimeout(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+
+	if tr.MaxIdleConns != 0 || tr.IdleConnTimeout != 0 {
+		t.Errorf("options modified the caller's transport")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		ok   bool
+	}{
+		{"no options", nil, true},
+		{"proxy", []Option{WithProxy("http://127.0.0.1:8080")}, true},
+		{"proxy with plain base url", []Option{WithProxy("http://127.0.0.1:8080"), WithBaseURL("http://example.com")}, false},
+		{"bad proxy scheme", []Option{WithProxy("ftp://127.0.0.1")}, false},
+		{"inverted back-off", []Option{WithWatchBackoff(time.Minute, time.Second, 2)}, false},
+		{"negative timeout", []Option{WithTimeout(-time.Second)}, false},
+		{"bad cert pin", []Option{WithCertPin("not a pin")}, false},
+		{"negative handshake timeout", []Option{WithTLSHandshakeTimeout(-time.Second)}, false},
+		{"zero body size", []Option{WithMaxBodySize(0)}, false},
+		{"relative referer", []Option{WithReferer("/inbox")}, false},
+		{"negative init retries", []Option{WithInitRetries(-1)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.opts...)
+			if (err == nil) != tt.ok {
+				t.Errorf("Got %v, want ok=%v", err, tt.ok)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("Got %v, want ErrInvalidOption", err)
+			}
+		})
+	}
+}
+
+func TestWithTransport(t *testing.T) {
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+endpointAddress {
+			token := fmt.Sprintf("token%d", len(tokens))
+			tokens = append(tokens, token)
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: token})
+			w.Write([]byte(`{"address":"test@example.com"}`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	tr, err := NewTransport(WithMaxIdleConns(10))
+	if err != nil {
+		t.Fatalf("unexpected error building transport: %s", err)
+	}
+
+	a, err := New(WithBaseURL(srv.URL), WithTransport(tr))
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+	b, err := New(WithBaseURL(srv.URL), WithTransport(tr))
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+
+	if a.c.Transport != tr || b.c.Transport != tr {
+		t.Error("sessions aren't using the shared transport")
+	}
+	if a.token == b.token {
+		t.Error("sessions sharing a transport share a token")
+	}
+
+	err = Validate(WithTransport(tr), WithMaxIdleConns(10))
+	if !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Got %v, want ErrInvalidOption", err)
+	}
+}
@@ -0,0 +1,79 @@
+package tmm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseAddressResponse(t *testing.T) {
+	addr, err := ParseAddressResponse([]byte(`{"address":"test@example.com"}`))
+	if err != nil || addr != "test@example.com" {
+		t.Errorf("Got %q, %v, want test@example.com", addr, err)
+	}
+
+	if _, err := ParseAddressResponse([]byte(`{}`)); !errors.Is(err, ErrMissingSession) {
+		t.Errorf("Got %v, want ErrMissingSession", err)
+	}
+	if _, err := ParseAddressResponse([]byte(`[`)); !errors.Is(err, ErrUnmarshalFailed) {
+		t.Errorf("Got %v, want ErrUnmarshalFailed", err)
+	}
+}
+
+func FuzzParseMessages(f *testing.F) {
+	f.Add([]byte(ExampleMessages))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(`{"messages":[{"id":"1"}]}`))
+	f.Add([]byte(`{"error":"Not Found"}`))
+	f.Add([]byte(`[{"sentDate":"not a date"}]`))
+	f.Add([]byte(``))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := ParseMessages(b)
+		if err != nil && len(m) > 0 {
+			t.Errorf("Got %d messages along with error %v", len(m), err)
+		}
+	})
+}
+
+func FuzzParseAddressResponse(f *testing.F) {
+	f.Add([]byte(`{"address":"test@example.com"}`))
+	f.Add([]byte(`{"address":1}`))
+	f.Add([]byte(`null`))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		addr, err := ParseAddressResponse(b)
+		if (err == nil) == (addr == "") {
+			t.Errorf("Got %q, %v, want exactly one of an address or an error", addr, err)
+		}
+	})
+}
+
+func TestParseMessagesShapes(t *testing.T) {
+	tests := []struct {
+		body string
+		want int
+	}{
+		{``, 0},
+		{`null`, 0},
+		{`[]`, 0},
+		{`{"messages":null}`, 0},
+		{`{"messages":[]}`, 0},
+		{`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"}]`, 1},
+		{` {"messages":[{"id":"1"},{"id":"2"}]}`, 2},
+	}
+
+	for _, tt := range tests {
+		m, err := ParseMessages([]byte(tt.body))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.body, err)
+			continue
+		}
+		if len(m) != tt.want {
+			t.Errorf("%s: Got %d messages, want %d", tt.body, len(m), tt.want)
+		}
+	}
+
+	if _, err := ParseMessages([]byte(`{"error":"Not Found"}`)); !errors.Is(err, ErrMailboxGone) {
+		t.Errorf("Got %v for an error object, want ErrMailboxGone", err)
+	}
+}
@@ -0,0 +1,281 @@
+package tmm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// poolRenewInterval is how often pools created by NewSessionPool
+// check whether their sessions need renewing.
+var poolRenewInterval = 30 * time.Second
+
+// Pool is a group of sessions which are used together, such as to
+// spread sign ups across several addresses.
+type Pool struct {
+	mu       sync.Mutex
+	sessions []*Session
+	// The index of the session to hand out next from Get.
+	next   int
+	closed bool
+
+	// Used by pools that create their own sessions. max is zero
+	// for pools that don't, and creating counts the sessions
+	// being created.
+	max      int
+	creating int
+	cfg      config
+	c        *http.Client
+
+	// Stops and waits for the renewal goroutine, if running.
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewPool returns a pool of the provided sessions.
+func NewPool(sessions ...*Session) *Pool {
+	return &Pool{sessions: sessions}
+}
+
+// NewSessionPool returns a pool which creates sessions with opts as
+// they are needed by Get, up to max at a time. The sessions share one
+// HTTP client and connection pool.
+//
+// Sessions in the pool are renewed in the background as they near
+// expiry, and removed from the pool if they expire or can't be
+// renewed. Call Close to stop renewing them once finished.
+func NewSessionPool(max int, opts ...Option) (*Pool, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("%w: pool size %d is less than 1", ErrInvalidOption, max)
+	}
+
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		max:    max,
+		cfg:    cfg,
+		c:      newClient(cfg),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go p.renewLoop(ctx)
+
+	return p, nil
+}
+
+// Add adds s to the pool.
+func (p *Pool) Add(s *Session) {
+	p.mu.Lock()
+	p.sessions = append(p.sessions, s)
+	p.mu.Unlock()
+}
+
+// Sessions returns the sessions in the pool.
+func (p *Pool) Sessions() []*Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]*Session(nil), p.sessions...)
+}
+
+// Get returns a session from the pool. Pools created by NewSessionPool
+// create a new session if they have fewer than their maximum, and
+// otherwise each call returns the next session in turn. Expired
+// sessions are removed from the pool rather than returned.
+//
+// ErrPoolEmpty is returned if there are no usable sessions and no
+// more can be created, and ErrPoolClosed once the pool is closed.
+func (p *Pool) Get() (*Session, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	// Drop expired sessions
+	live := p.sessions[:0]
+	for _, s := range p.sessions {
+		if !s.Expired() {
+			live = append(live, s)
+		}
+	}
+	p.sessions = live
+
+	if len(p.sessions)+p.creating < p.max {
+		p.creating++
+		p.mu.Unlock()
+		s, err := newSession(&Session{
+			baseurl:   p.cfg.baseURL,
+			c:         p.c,
+			cfg:       p.cfg,
+			lastreset: time.Now(),
+		})
+		p.mu.Lock()
+		p.creating--
+
+		if err != nil {
+			return nil, err
+		}
+		if p.closed {
+			return nil, ErrPoolClosed
+		}
+		p.sessions = append(p.sessions, s)
+		return s, nil
+	}
+
+	if len(p.sessions) == 0 {
+		return nil, ErrPoolEmpty
+	}
+
+	s := p.sessions[p.next%len(p.sessions)]
+	p.next++
+
+	return s, nil
+}
+
+// Close stops renewing the sessions in the pool and removes them.
+// Later calls to Get fail with ErrPoolClosed. The sessions themselves
+// remain usable until they expire.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.sessions = nil
+	p.mu.Unlock()
+
+	if p.cancel != nil {
+		p.cancel()
+		<-p.done
+	}
+	if p.c != nil {
+		p.c.CloseIdleConnections()
+	}
+}
+
+// renewLoop renews the sessions in the pool until ctx is done.
+func (p *Pool) renewLoop(ctx context.Context) {
+	defer close(p.done)
+
+	t := time.NewTicker(poolRenewInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			p.renew()
+		}
+	}
+}
+
+// renew renews any sessions close to expiry, removing those that
+// can't be renewed.
+func (p *Pool) renew() {
+	for _, s := range p.Sessions() {
+		if _, err := s.RenewIfNeeded(renewThreshold); err != nil {
+			p.remove(s)
+		}
+	}
+}
+
+// remove removes s from the pool.
+func (p *Pool) remove(s *Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, ps := range p.sessions {
+		if ps == s {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// ParallelMessages calls Messages on every session in the pool, with
+// up to concurrency calls running at once, and returns all of the
+// messages sorted by the time they were sent, oldest first. A
+// concurrency less than 1 means no limit.
+//
+// If any sessions fail, the messages from the rest are returned along
+// with a *MultiError holding each failure, keyed by session address.
+// Sessions which haven't been fetched from by the time ctx is done
+// fail with ctx.Err().
+func (p *Pool) ParallelMessages(ctx context.Context, concurrency int) ([]Message, error) {
+	sessions := p.Sessions()
+	if concurrency < 1 {
+		concurrency = len(sessions)
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		all      []Message
+		failures []BatchFailure
+		sem      = make(chan struct{}, concurrency)
+	)
+
+	for i, s := range sessions {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			mu.Lock()
+			failures = append(failures, BatchFailure{Index: i, Key: s.Address(), Err: ctx.Err()})
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, s *Session) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			m, err := s.Messages()
+
+			mu.Lock()
+			defer mu.Unlock()
+			all = append(all, m...)
+			if err != nil {
+				failures = append(failures, BatchFailure{Index: i, Key: s.Address(), Err: err})
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].SentDate.Before(all[j].SentDate)
+	})
+
+	if len(failures) > 0 {
+		sort.Slice(failures, func(i, j int) bool {
+			return failures[i].Index < failures[j].Index
+		})
+		return all, &MultiError{BatchError{Failures: failures}}
+	}
+
+	return all, nil
+}
+
+// MultiError holds the failures from an operation carried out on many
+// sessions at once, keyed by session address. It is a BatchError, which
+// errors.As also finds, and errors.Is and errors.As check each failure.
+type MultiError struct {
+	BatchError
+}
+
+// As makes the embedded BatchError available to errors.As.
+func (e *MultiError) As(target any) bool {
+	if t, ok := target.(**BatchError); ok {
+		*t = &e.BatchError
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,173 @@
+package tmm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParallelMessages(t *testing.T) {
+	var running, peak int32
+	handler := func(minute int, status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			fmt.Fprintf(w, `[{"id":"%d","sentDate":"2021-11-28T08:%02d:06.000+00:00"}]`, minute, minute)
+		}
+	}
+
+	p := NewPool(
+		newTestSession(t, handler(3, http.StatusOK)),
+		newTestSession(t, handler(1, http.StatusOK)),
+		newTestSession(t, handler(0, http.StatusForbidden)),
+		newTestSession(t, handler(2, http.StatusOK)),
+	)
+
+	m, err := p.ParallelMessages(context.Background(), 2)
+
+	var merr *MultiError
+	if !errors.As(err, &merr) || len(merr.Failures) != 1 || !errors.Is(err, ErrBlockedByServer) {
+		t.Errorf("Got %v, want one ErrBlockedByServer", err)
+	} else if f := merr.Failures[0]; f.Index != 2 || f.Key != "test@example.com" {
+		t.Errorf("Got failure %+v, want the third session keyed by its address", f)
+	}
+	var berr *BatchError
+	if !errors.As(err, &berr) || berr != &merr.BatchError {
+		t.Errorf("Got %v, want the MultiError to be found as a BatchError", err)
+	}
+	if len(m) != 3 || m[0].ID != "1" || m[1].ID != "2" || m[2].ID != "3" {
+		t.Errorf("Got %v, want messages 1, 2 and 3 in order", m)
+	}
+	if peak > 2 {
+		t.Errorf("Got %d concurrent fetches, want at most 2", peak)
+	}
+}
+
+func TestSessionPool(t *testing.T) {
+	var created, resets int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+endpointAddress {
+			n := atomic.AddInt32(&created, 1)
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: fmt.Sprint("token", n)})
+			fmt.Fprintf(w, `{"address":"test%d@example.com"}`, n)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, endpointSecondsLeft) {
+			w.Write([]byte(`{"secondsLeft":30}`))
+			return
+		}
+		atomic.AddInt32(&resets, 1)
+		w.Write([]byte(`{"Response":"reset"}`))
+	}))
+	defer srv.Close()
+
+	p, err := NewSessionPool(2, WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error creating pool: %s", err)
+	}
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		s, err := p.Get()
+		if err != nil {
+			t.Fatalf("unexpected error getting session: %s", err)
+		}
+		got = append(got, s.Address())
+	}
+	if strings.Join(got, " ") != "test1@example.com test2@example.com test1@example.com" || created != 2 {
+		t.Errorf("Got %q from %d sessions, want two sessions reused in turn", got, created)
+	}
+
+	// The first is renewed, and the second has expired so is replaced
+	sessions := p.Sessions()
+	sessions[0].lastreset = time.Now().Add(-9*time.Minute - 30*time.Second)
+	sessions[1].lastreset = time.Now().Add(-10 * time.Minute)
+	p.renew()
+	if resets != 1 {
+		t.Errorf("Got %d renewals, want 1", resets)
+	}
+
+	if _, err := p.Get(); err != nil || created != 3 {
+		t.Errorf("Got %v with %d sessions created, want expired session replaced", err, created)
+	}
+
+	p.Close()
+	if _, err := p.Get(); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("Got %v, want ErrPoolClosed", err)
+	}
+}
+
+func TestPoolRenewRace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/"+endpointAddress:
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+			w.Write([]byte(`{"address":"test@example.com"}`))
+		case r.URL.Path == "/"+endpointReset:
+			w.Write([]byte(`{"Response":"reset","address":"renewed@example.com"}`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer srv.Close()
+
+	p, err := NewSessionPool(1, WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error creating pool: %s", err)
+	}
+	defer p.Close()
+
+	s, err := p.Get()
+	if err != nil {
+		t.Fatalf("unexpected error getting session: %s", err)
+	}
+	s.lastreset = time.Now().Add(-9*time.Minute - 30*time.Second)
+
+	// Run with -race: renewing writes the address and expiry while
+	// callers read them
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.renew()
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if s, err := p.Get(); err == nil {
+				s.Latest()
+				s.Address()
+			}
+		}
+	}()
+	wg.Wait()
+
+	if s.Address() != "renewed@example.com" || time.Until(s.ExpiresAt()) < 9*time.Minute {
+		t.Errorf("Got %s expiring at %s, want the session renewed", s.Address(), s.ExpiresAt())
+	}
+}
+
+func TestPoolEmpty(t *testing.T) {
+	if _, err := NewPool().Get(); !errors.Is(err, ErrPoolEmpty) {
+		t.Errorf("Got %v, want ErrPoolEmpty", err)
+	}
+}
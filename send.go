@@ -0,0 +1,68 @@
+package tmm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// sendLimiter spaces out replies and forwards to stay under the cap
+// the server puts on sending mail, separately from WithRateLimit.
+type sendLimiter struct {
+	lim *rate.Limiter
+
+	// The clock, replaced in tests.
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+func newSendLimiter(perMinute int) *sendLimiter {
+	return &sendLimiter{
+		lim:   rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), 1),
+		now:   time.Now,
+		after: time.After,
+	}
+}
+
+// take waits for a send to be allowed, or fails with
+// ErrSendRateExceeded if it isn't allowed yet and failFast is set,
+// or the wait would outlast ctx.
+func (l *sendLimiter) take(ctx context.Context, failFast bool) error {
+	now := l.now()
+	r := l.lim.ReserveN(now, 1)
+	d := r.DelayFrom(now)
+	if d == 0 {
+		return nil
+	}
+
+	if failFast {
+		r.CancelAt(now)
+		return fmt.Errorf("%w: next send allowed in %s", ErrSendRateExceeded, d)
+	}
+	if deadline, ok := ctx.Deadline(); ok && now.Add(d).After(deadline) {
+		r.CancelAt(now)
+		return fmt.Errorf("%w: %w", ErrSendRateExceeded, context.DeadlineExceeded)
+	}
+
+	select {
+	case <-l.after(d):
+		return nil
+	case <-ctx.Done():
+		r.CancelAt(l.now())
+		return fmt.Errorf("%w: %w", ErrSendRateExceeded, ctx.Err())
+	}
+}
+
+// waitSend waits for the send limiter, if configured, to allow a reply
+// or forward, or until ctx is done. The wait isn't bound by the client
+// timeout, as at a few sends a minute it could easily be longer, and
+// is never more than the interval between sends.
+func (s *Session) waitSend(ctx context.Context) error {
+	if s.cfg.sendLimiter == nil {
+		return nil
+	}
+
+	return s.cfg.sendLimiter.take(ctx, s.cfg.sendFailFast)
+}
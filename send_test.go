@@ -0,0 +1,115 @@
+package tmm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock stands in for the clock of a sendLimiter, moving time on
+// by each wait rather than sleeping. If block is set, waits never end.
+type fakeClock struct {
+	t     time.Time
+	waits []time.Duration
+	block bool
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+
+	ch := make(chan time.Time, 1)
+	if !c.block {
+		c.t = c.t.Add(d)
+		ch <- c.t
+	}
+	return ch
+}
+
+func TestSendRate(t *testing.T) {
+	var sends int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/messages/") {
+			atomic.AddInt32(&sends, 1)
+		}
+	}
+
+	s := newTestSession(t, handler, WithSendRate(2))
+	clock := &fakeClock{t: time.Now()}
+	s.cfg.sendLimiter.now, s.cfg.sendLimiter.after = clock.now, clock.after
+
+	for i := 0; i < 3; i++ {
+		if ok, err := s.Forward("1", "someone@example.com"); !ok || err != nil {
+			t.Fatalf("Got %v, %v forwarding, want success", ok, err)
+		}
+	}
+	if ok, err := s.Reply("1", "hello"); !ok || err != nil {
+		t.Fatalf("Got %v, %v replying, want success", ok, err)
+	}
+
+	if want := []time.Duration{30 * time.Second, 30 * time.Second, 30 * time.Second}; !reflect.DeepEqual(clock.waits, want) {
+		t.Errorf("Got waits %v, want %v", clock.waits, want)
+	}
+	if n := atomic.LoadInt32(&sends); n != 4 {
+		t.Errorf("Got %d sends, want 4", n)
+	}
+}
+
+func TestSendFailFast(t *testing.T) {
+	var sends int32
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sends, 1)
+	}, WithSendFailFast(), WithSendRate(1))
+	clock := &fakeClock{t: time.Now()}
+	s.cfg.sendLimiter.now, s.cfg.sendLimiter.after = clock.now, clock.after
+
+	if _, err := s.Reply("1", "hello"); err != nil {
+		t.Fatalf("unexpected error on first reply: %s", err)
+	}
+	if _, err := s.Reply("1", "hello"); !errors.Is(err, ErrSendRateExceeded) {
+		t.Errorf("Got %v, want ErrSendRateExceeded", err)
+	}
+	if n := atomic.LoadInt32(&sends); n != 1 {
+		t.Errorf("Got %d sends, want only the first", n)
+	}
+
+	// A refused send doesn't use up the next slot
+	clock.t = clock.t.Add(time.Minute)
+	if _, err := s.Reply("1", "hello"); err != nil {
+		t.Errorf("unexpected error a minute later: %s", err)
+	}
+	if len(clock.waits) != 0 {
+		t.Errorf("Got waits %v, want none when failing fast", clock.waits)
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	var sends int32
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sends, 1)
+	}, WithSendRate(1))
+	clock := &fakeClock{t: time.Now(), block: true}
+	s.cfg.sendLimiter.now, s.cfg.sendLimiter.after = clock.now, clock.after
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := s.ReplyContext(ctx, "1", "hello"); err != nil {
+		t.Fatalf("unexpected error on first reply: %s", err)
+	}
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err := s.ForwardContext(ctx, "1", "someone@example.com")
+	if !errors.Is(err, ErrSendRateExceeded) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Got %v, want the wait cancelled", err)
+	}
+	if n := atomic.LoadInt32(&sends); n != 1 || len(clock.waits) != 1 {
+		t.Errorf("Got %d sends after waits %v, want only the first sent", n, clock.waits)
+	}
+}
@@ -0,0 +1,129 @@
+package tmm
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionStats describes the requests made by a session and what they
+// returned, as reported by Session.Stats.
+type SessionStats struct {
+	// The number of requests made, and how many of them failed or
+	// were answered with an error status.
+	TotalRequests int64
+	TotalErrors   int64
+	// The number of response body bytes read.
+	TotalBytesRead int64
+	// The number of messages returned by fetches, such as Messages
+	// and Latest.
+	TotalMessagesReceived int64
+
+	// When the session was created, and when the most recent
+	// request was made. LastRequestAt is zero if none have been.
+	SessionCreatedAt time.Time
+	LastRequestAt    time.Time
+
+	// The mean time taken by requests.
+	AverageRequestDuration time.Duration
+}
+
+// sessionStats holds the counters behind SessionStats. They're
+// updated atomically under a read lock, so concurrent requests never
+// wait on each other, only on a snapshot or reset taking the lock.
+type sessionStats struct {
+	createdAt time.Time
+
+	mu sync.RWMutex
+
+	requests atomic.Int64
+	errors   atomic.Int64
+	bytes    atomic.Int64
+	messages atomic.Int64
+	// Total request time, and the time of the last request,
+	// in nanoseconds.
+	duration    atomic.Int64
+	lastRequest atomic.Int64
+}
+
+// observe records a request which started at start and took d.
+func (st *sessionStats) observe(start time.Time, d time.Duration, failed bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	st.requests.Add(1)
+	if failed {
+		st.errors.Add(1)
+	}
+	st.duration.Add(int64(d))
+	st.lastRequest.Store(start.UnixNano())
+}
+
+// addBytes records n response body bytes read.
+func (st *sessionStats) addBytes(n int) {
+	st.mu.RLock()
+	st.bytes.Add(int64(n))
+	st.mu.RUnlock()
+}
+
+// addMessages records n messages returned by a fetch.
+func (st *sessionStats) addMessages(n int) {
+	st.mu.RLock()
+	st.messages.Add(int64(n))
+	st.mu.RUnlock()
+}
+
+// snapshot returns the current statistics. The caller must hold mu.
+func (st *sessionStats) snapshot() SessionStats {
+	v := SessionStats{
+		TotalRequests:         st.requests.Load(),
+		TotalErrors:           st.errors.Load(),
+		TotalBytesRead:        st.bytes.Load(),
+		TotalMessagesReceived: st.messages.Load(),
+		SessionCreatedAt:      st.createdAt,
+	}
+
+	if last := st.lastRequest.Load(); last != 0 {
+		v.LastRequestAt = time.Unix(0, last)
+	}
+	if v.TotalRequests > 0 {
+		v.AverageRequestDuration = time.Duration(st.duration.Load() / v.TotalRequests)
+	}
+
+	return v
+}
+
+// Stats returns a snapshot of the session's request statistics.
+// The counters are read together, so the snapshot is consistent
+// even while requests are being made.
+func (s *Session) Stats() SessionStats {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+
+	return s.stats.snapshot()
+}
+
+// StatsSnapshot is the same as Stats, named to pair with ResetStats.
+func (s *Session) StatsSnapshot() SessionStats {
+	return s.Stats()
+}
+
+// ResetStats zeroes the session's request statistics, other than
+// when it was created, returning them as they were just before. Each
+// request is counted in exactly one of the returned snapshots, so
+// monitoring code can call it at intervals to sample each interval.
+func (s *Session) ResetStats() SessionStats {
+	st := &s.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	v := st.snapshot()
+	st.requests.Store(0)
+	st.errors.Store(0)
+	st.bytes.Store(0)
+	st.messages.Store(0)
+	st.duration.Store(0)
+	st.lastRequest.Store(0)
+
+	return v
+}
@@ -0,0 +1,81 @@
+package tmm
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	fail := false
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"}]`))
+	})
+
+	if _, err := s.Messages(); err != nil {
+		t.Fatalf("unexpected error fetching messages: %s", err)
+	}
+	fail = true
+	s.Latest()
+
+	st := s.Stats()
+	if st.TotalRequests != 3 || st.TotalErrors != 1 {
+		t.Errorf("Got %d requests and %d errors, want 3 and 1", st.TotalRequests, st.TotalErrors)
+	}
+	if st.TotalMessagesReceived != 1 {
+		t.Errorf("Got %d messages, want 1", st.TotalMessagesReceived)
+	}
+	if st.TotalBytesRead == 0 || st.AverageRequestDuration == 0 {
+		t.Errorf("Got %+v, want bytes and durations recorded", st)
+	}
+	if time.Since(st.SessionCreatedAt) > time.Minute || st.LastRequestAt.Before(st.SessionCreatedAt) {
+		t.Errorf("Got created %s and last request %s", st.SessionCreatedAt, st.LastRequestAt)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"}]`))
+	})
+
+	const workers, fetches = 4, 10
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < fetches; j++ {
+				s.Messages()
+			}
+		}()
+	}
+
+	// Sample while fetching, as monitoring code would. The first
+	// sample also has the request which created the session.
+	total := s.ResetStats().TotalRequests - 1
+	for i := 0; i < 5; i++ {
+		total += s.ResetStats().TotalRequests
+	}
+	wg.Wait()
+
+	snap := s.StatsSnapshot()
+	if total += snap.TotalRequests; total != workers*fetches {
+		t.Errorf("Got %d requests over the samples, want %d", total, workers*fetches)
+	}
+	if snap != s.Stats() {
+		t.Errorf("Got %+v, want the snapshot to match Stats", snap)
+	}
+
+	created := snap.SessionCreatedAt
+	if st := s.ResetStats(); st != snap {
+		t.Errorf("Got %+v from reset, want %+v", st, snap)
+	}
+	if st := s.Stats(); st != (SessionStats{SessionCreatedAt: created}) {
+		t.Errorf("Got %+v after reset, want zeroed counters", st)
+	}
+}
@@ -1,31 +1,40 @@
 // Package tmm provides a simple interface to the 10MinuteMail web service.
-//   // Create a new session
-//   s, err := tmm.New()
-//   if err != nil {
-// 	   log.Fatal(err)
-//   }
-//
-//   // Check the email address
-//   addr := s.Address()
-//
-//   // Retrieve all messages
-//   mail, err := s.Messages()
-//   for _, m := range mail {
-// 	   fmt.Println(mail.Plaintext)
-//   }
+//
+//	// Create a new session
+//	s, err := tmm.New()
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	// Check the email address
+//	addr := s.Address()
+//
+//	// Retrieve all messages
+//	mail, err := s.Messages()
+//	for _, m := range mail {
+//		fmt.Println(m.Plaintext)
+//	}
 package tmm
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net"
+	"log/slog"
 	"net/http"
+	"net/mail"
 	"net/url"
+	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	tls "github.com/refraction-networking/utls"
@@ -36,87 +45,192 @@ const (
 	DefaultTimeout   = 10 * time.Second
 	DateLayout       = "2006-01-02T15:04:05.000+00:00"
 	DefaultUserAgent = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/97.0.4692.99 Safari/537.36"
+	DefaultLocale    = "en-US,en;q=0.9"
 
 	baseURL = "https://10minutemail.com"
 
+	// How close to expiry a session is allowed to get before
+	// Receive renews it.
+	renewThreshold = time.Minute
+
+	// How many message IDs are remembered by WithDedup.
+	dedupSize = 1000
+
+	// How many TLS sessions each transport remembers for resumption.
+	sessionCacheSize = 64
+
+	// The largest response body read unless changed with
+	// WithMaxBodySize.
+	defaultMaxBodySize = 4 << 20
+
+	// How many sessions NewWithDomain creates looking for an
+	// address on the requested domain.
+	domainAttempts = 10
+
 	endpointAddress     = "session/address"
 	endpointExpired     = "session/expired"
 	endpointReset       = "session/reset"
 	endpointSecondsLeft = "session/secondsLeft"
 
+	endpointMessageCount   = "messages/messageCount"
 	endpointMessagesAfter  = "messages/messagesAfter"
 	endpointMessageReply   = "messages/reply"
 	endpointMessageForward = "messages/forward"
 )
 
+// readyBackoff is the retry schedule used by WaitReady.
+var readyBackoff = &backoff{min: 100 * time.Millisecond, max: 5 * time.Second, factor: 2}
+
+// initRetryDelay is how long to wait between attempts to create a
+// session when WithInitRetries is used.
+var initRetryDelay = 500 * time.Millisecond
+
 var (
-	ErrBuildingRequest = errors.New("failed to construct request object")
-	ErrRequestFailed   = errors.New("request to 10minutemail failed")
-	ErrReadBody        = errors.New("reading response body failed")
-	ErrMarshalFailed   = errors.New("marshalling request body failed")
-	ErrUnmarshalFailed = errors.New("unmarshalling response body failed")
-	ErrMissingSession  = errors.New("missing session cookie in response")
-	ErrBlockedByServer = errors.New("server is blocking requests from this host; probably rate limited")
+	ErrBuildingRequest   = errors.New("failed to construct request object")
+	ErrRequestFailed     = errors.New("request to 10minutemail failed")
+	ErrReadBody          = errors.New("reading response body failed")
+	ErrMarshalFailed     = errors.New("marshalling request body failed")
+	ErrUnmarshalFailed   = errors.New("unmarshalling response body failed")
+	ErrMissingSession    = errors.New("missing session cookie in response")
+	ErrBlockedByServer   = errors.New("server is blocking requests from this host; probably rate limited")
+	ErrInvalidOption     = errors.New("invalid option")
+	ErrRenewRejected     = errors.New("server rejected session renewal")
+	ErrMessageNotFound   = errors.New("no message with that id in mailbox")
+	ErrCertPinMismatch   = errors.New("server certificate doesn't match any pinned key")
+	ErrSessionExpired    = errors.New("session has expired")
+	ErrNilSession        = errors.New("session is nil")
+	ErrRateLimited       = errors.New("request would exceed the configured rate limit")
+	ErrMailboxGone       = errors.New("mailbox no longer exists on server; session has probably expired")
+	ErrInvalidPattern    = errors.New("invalid pattern")
+	ErrDomainUnavailable = errors.New("no address available on the requested domain")
+	ErrBodyTooLarge      = errors.New("response body exceeds the size limit")
+	ErrInvalidMIME       = errors.New("message body isn't a valid MIME payload")
+	ErrPoolClosed        = errors.New("pool has been closed")
+	ErrPoolEmpty         = errors.New("pool has no usable sessions")
+	ErrInvalidRecipient  = errors.New("invalid recipient address")
+	ErrForwardToSelf     = errors.New("can't forward a message to the session's own address")
+	ErrExpiredMessage    = errors.New("message is too old to reply to or forward")
+	ErrSendRateExceeded  = errors.New("too many replies or forwards sent")
 )
 
-// TLS fingerprint for Cloudflare bypass
-var spec = &tls.ClientHelloSpec{
-	CipherSuites: []uint16{
-		49195,
-		49196,
-		52393,
-		49199,
-		49200,
-		52392,
-		158,
-		159,
-		49161,
-		49162,
-		49171,
-		49172,
-		51,
-		57,
-		156,
-		157,
-		47,
-		53,
-	},
-	Extensions: []tls.TLSExtension{
-		&tls.RenegotiationInfoExtension{
-			Renegotiation: 0,
-		},
-		&tls.SNIExtension{
-			ServerName: "",
-		},
-		&tls.UtlsExtendedMasterSecretExtension{},
-		&tls.GenericExtension{
-			Id:   35,
-			Data: nil,
+// newSpec returns the TLS fingerprint used for Cloudflare bypass.
+// A fresh spec is built for each connection since applying it to
+// a connection modifies its extensions.
+func newSpec(cfg config) *tls.ClientHelloSpec {
+	alpn := []string{"http/1.1"}
+	if cfg.http2 {
+		alpn = []string{"h2", "http/1.1"}
+	}
+
+	spec := &tls.ClientHelloSpec{
+		CipherSuites: []uint16{
+			49195,
+			49196,
+			52393,
+			49199,
+			49200,
+			52392,
+			158,
+			159,
+			49161,
+			49162,
+			49171,
+			49172,
+			51,
+			57,
+			156,
+			157,
+			47,
+			53,
 		},
-		&tls.SignatureAlgorithmsExtension{
-			SupportedSignatureAlgorithms: []tls.SignatureScheme{
-				1027,
-				1025,
+		Extensions: []tls.TLSExtension{
+			&tls.RenegotiationInfoExtension{
+				Renegotiation: 0,
 			},
-		},
-		&tls.ALPNExtension{
-			AlpnProtocols: []string{
-				"http/1.1",
+			&tls.SNIExtension{
+				ServerName: "",
 			},
-		},
-		&tls.SupportedPointsExtension{
-			SupportedPoints: []uint8{
-				0,
+			&tls.UtlsExtendedMasterSecretExtension{},
+			&tls.SessionTicketExtension{},
+			&tls.SignatureAlgorithmsExtension{
+				SupportedSignatureAlgorithms: []tls.SignatureScheme{
+					1027,
+					1025,
+				},
 			},
-		},
-		&tls.SupportedCurvesExtension{
-			Curves: []tls.CurveID{
-				23,
+			&tls.ALPNExtension{
+				AlpnProtocols: alpn,
+			},
+			&tls.SupportedPointsExtension{
+				SupportedPoints: []uint8{
+					0,
+				},
+			},
+			&tls.SupportedCurvesExtension{
+				Curves: []tls.CurveID{
+					23,
+				},
 			},
 		},
-	},
-	TLSVersMin: 769,
-	TLSVersMax: 771,
+		TLSVersMin: 769,
+		TLSVersMax: 771,
+	}
+
+	if cfg.cipherSuites != nil {
+		spec.CipherSuites = append([]uint16(nil), cfg.cipherSuites...)
+	}
+	if cfg.tlsMax != 0 {
+		setVersions(spec, cfg.tlsMin, cfg.tlsMax, cfg.cipherSuites == nil)
+	}
+
+	return spec
+}
+
+// setVersions makes spec offer TLS versions min to max. Offering TLS 1.3
+// takes extra extensions, which are added alongside the existing ones so
+// the rest of the fingerprint is kept, along with the TLS 1.3 cipher
+// suites unless addSuites is false.
+func setVersions(spec *tls.ClientHelloSpec, min, max uint16, addSuites bool) {
+	spec.TLSVersMin, spec.TLSVersMax = min, max
+	if max < tls.VersionTLS13 {
+		return
+	}
+
+	// uTLS won't take a minimum above TLS 1.2, so the supported
+	// versions extension alone rules out older versions. dialTLS
+	// checks the version the server picked.
+	if min > tls.VersionTLS12 {
+		spec.TLSVersMin = tls.VersionTLS12
+	}
+
+	if addSuites {
+		spec.CipherSuites = append([]uint16{
+			tls.TLS_AES_128_GCM_SHA256,
+			tls.TLS_AES_256_GCM_SHA384,
+			tls.TLS_CHACHA20_POLY1305_SHA256,
+		}, spec.CipherSuites...)
+	}
+
+	for _, ext := range spec.Extensions {
+		switch ext := ext.(type) {
+		case *tls.SignatureAlgorithmsExtension:
+			// Required for RSA certificates under TLS 1.3
+			ext.SupportedSignatureAlgorithms = append(ext.SupportedSignatureAlgorithms, tls.PSSWithSHA256)
+		case *tls.SupportedCurvesExtension:
+			ext.Curves = append(ext.Curves, tls.X25519)
+		}
+	}
+
+	var versions []uint16
+	for v := max; v >= min; v-- {
+		versions = append(versions, v)
+	}
+
+	spec.Extensions = append(spec.Extensions,
+		&tls.KeyShareExtension{KeyShares: []tls.KeyShare{{Group: tls.X25519}}},
+		&tls.PSKKeyExchangeModesExtension{Modes: []uint8{tls.PskModeDHE}},
+		&tls.SupportedVersionsExtension{Versions: versions},
+	)
 }
 
 // Message represents a single email message sent to a temporary mail.
@@ -136,8 +250,13 @@ type Message struct {
 	HTML string `json:"html"`
 	// A short preview of the message body.
 	Preview string `json:"preview"`
+	// The sent date exactly as given by the server. If it couldn't
+	// be parsed, SentDate is left as the zero time.
+	RawSentDate string `json:"-"`
 }
 
+// UnmarshalJSON accepts messages both as sent by the server and as
+// written by MarshalJSON.
 func (m *Message) UnmarshalJSON(data []byte) error {
 	// Hacky workaround for custom time format.
 	// See https://github.com/golang/go/issues/21990.
@@ -149,6 +268,11 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 		Plaintext string `json:"bodyPlainText"`
 		HTML      string `json:"bodyHtmlContent"`
 		Preview   string `json:"bodyPreview"`
+
+		// The names used by MarshalJSON
+		CleanPlaintext string `json:"plaintext"`
+		CleanHTML      string `json:"html"`
+		CleanPreview   string `json:"preview"`
 	}
 
 	v := &aux{}
@@ -159,294 +283,1929 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 	m.ID = v.ID
 	m.Sender = v.Sender
 	m.Subject = v.Subject
-	m.Plaintext = v.Plaintext
-	m.HTML = v.HTML
-	m.Preview = v.Preview
+	m.Plaintext = firstNonEmpty(v.Plaintext, v.CleanPlaintext)
+	m.HTML = firstNonEmpty(v.HTML, v.CleanHTML)
+	m.Preview = firstNonEmpty(v.Preview, v.CleanPreview)
+
+	// Custom time handler. A date in an unknown format shouldn't lose
+	// the whole message, so it's left for the caller to deal with.
+	m.RawSentDate = v.SentDate
+	m.SentDate, _ = parseDate(v.SentDate)
+
+	return nil
+}
+
+// MarshalJSON writes the message using the field names of Message,
+// with the sent date in the server's format, DateLayout. Dates are
+// converted to UTC and, like the server's, kept to the millisecond.
+// If the sent date is zero, RawSentDate is written instead.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type aux struct {
+		ID        string `json:"id"`
+		SentDate  string `json:"sentDate"`
+		Sender    string `json:"sender"`
+		Subject   string `json:"subject"`
+		Plaintext string `json:"plaintext"`
+		HTML      string `json:"html"`
+		Preview   string `json:"preview"`
+	}
+
+	date := m.SentDate.UTC().Format(DateLayout)
+	if m.SentDate.IsZero() && m.RawSentDate != "" {
+		date = m.RawSentDate
+	}
+
+	return json.Marshal(aux{
+		ID:        m.ID,
+		SentDate:  date,
+		Sender:    m.Sender,
+		Subject:   m.Subject,
+		Plaintext: m.Plaintext,
+		HTML:      m.HTML,
+		Preview:   m.Preview,
+	})
+}
+
+// firstNonEmpty returns the first of values which isn't empty.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// dateLayouts are the formats tried, in order, when parsing
+// the sent date of a message.
+var dateLayouts = []string{
+	DateLayout,
+	"2006-01-02T15:04:05.000-0700",
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05.000Z07:00",
+	time.RFC3339Nano,
+	time.RFC3339,
+}
 
-	// Custom time handler
-	t, err := time.Parse(DateLayout, v.SentDate)
+// parseDate parses a sent date in any of the known layouts,
+// returning the error from the first layout if none match.
+func parseDate(v string) (time.Time, error) {
+	var first error
+	for _, layout := range dateLayouts {
+		t, err := time.Parse(layout, v)
+		if err == nil {
+			return t, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+
+	return time.Time{}, first
+}
+
+// Extract searches the message subject, plaintext body and HTML body,
+// in that order, for pattern. If the pattern contains a capturing group
+// the first group is returned, otherwise the whole match is.
+func (m *Message) Extract(pattern *regexp.Regexp) (string, bool) {
+	for _, field := range []string{m.Subject, m.Plaintext, m.HTML} {
+		match := pattern.FindStringSubmatch(field)
+		if match == nil {
+			continue
+		}
+		if len(match) > 1 {
+			return match[1], true
+		}
+		return match[0], true
+	}
+
+	return "", false
+}
+
+// PlaintextReader returns a reader over the plaintext message body.
+func (m *Message) PlaintextReader() io.Reader {
+	return strings.NewReader(m.Plaintext)
+}
+
+// HTMLReader returns a reader over the text content of the HTML
+// message body, with tags, comments, scripts and styles removed. The
+// body is parsed as it is read, so the text is never held in memory
+// all at once. Closing the reader stops parsing.
+func (m *Message) HTMLReader() io.ReadCloser {
+	return newHTMLTextReader(strings.NewReader(m.HTML))
+}
+
+// AddressResponse is the response from the server to the request that
+// creates a session.
+type AddressResponse struct {
+	// The email address attached to the session.
+	Address string
+	// Every field in the response, including Address and any that
+	// aren't otherwise exposed, as raw JSON.
+	Fields map[string]json.RawMessage
+}
+
+// ParseAddressResponse returns the address from the server's response
+// to a request to create a session. An error wrapping ErrMissingSession
+// is returned if it doesn't contain one.
+func ParseAddressResponse(b []byte) (string, error) {
+	v, err := parseAddressResponse(b)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if v.Address == "" {
+		return "", fmt.Errorf("%w: no address", ErrMissingSession)
 	}
 
-	m.SentDate = t
+	return v.Address, nil
+}
 
-	return nil
+// parseAddressResponse unmarshals the response to an address request.
+func parseAddressResponse(b []byte) (*AddressResponse, error) {
+	v := &AddressResponse{}
+	if err := json.Unmarshal(b, &v.Fields); err != nil {
+		return nil, &RequestError{Kind: ErrUnmarshalFailed, Err: err}
+	}
+	if raw, ok := v.Fields["address"]; ok {
+		if err := json.Unmarshal(raw, &v.Address); err != nil {
+			return nil, &RequestError{Kind: ErrUnmarshalFailed, Err: err}
+		}
+	}
+
+	return v, nil
 }
 
 // Session holds information required to maintain a 10MinuteMail session.
 type Session struct {
+	// The address of the session, guarded by mu.
 	address string
-	token   string
+	// The session token, guarded by mu. It may be replaced by the
+	// server in any response.
+	token string
+
+	// The cookies set by the server when the session was created,
+	// guarded by mu.
+	cookies []*http.Cookie
 
-	// The last time the session was reset.
+	// The response to the address request the session was created
+	// with, guarded by mu.
+	addrres *AddressResponse
+
+	// The last time the session was reset, guarded by mu. Writers
+	// also hold fetchmu if they update lastcount with it.
 	lastreset time.Time
 
+	// The time the server first handed out the session's address.
+	createdat time.Time
+
 	// The number of the last message fetched,
 	// to ensure we aren't refetching the same data.
+	// Only read or written while holding fetchmu.
 	lastcount int64
 
+	// fetchmu serialises message fetches so lastcount stays consistent.
+	// inflight counts the fetches running or waiting on fetchmu, and is
+	// guarded by mu so TryLatest can check it without blocking.
+	fetchmu  sync.Mutex
+	mu       sync.Mutex
+	inflight int
+
+	// The messages returned by the last fetch, guarded by mu.
+	last []Message
+
+	// Functions registered with OnMessage, guarded by mu.
+	onmessage []func(Message)
+
+	// Messages fetched by Next but not yet returned, oldest first,
+	// guarded by mu.
+	pending []Message
+
+	// IDs of messages already returned, when deduplication is
+	// enabled. Only used while holding fetchmu.
+	seen *seenSet
+
+	// Expiry timer backing Done and OnExpiry, guarded by expmu.
+	expmu    sync.Mutex
+	exptimer *time.Timer
+	done     chan struct{}
+	onexpiry []func()
+
+	stats sessionStats
+
+	// The unchanging parts of the request made when polling.
+	poll pollTemplate
+
 	baseurl string
 	c       *http.Client
+	cfg     config
 }
 
-// headers returns the default set of headers to be sent with every request.
-func (s *Session) headers() http.Header {
-	return http.Header{
-		"User-Agent": []string{DefaultUserAgent},
+// headers returns the default set of headers to be sent with every
+// request made with method. Like a browser, the page requests appear
+// to come from is sent as the Referer, and the Origin is sent with
+// POST requests.
+func (s *Session) headers(method string) http.Header {
+	h := http.Header{
+		"User-Agent":      []string{s.cfg.userAgent},
+		"Accept-Language": []string{s.cfg.locale},
 	}
-}
 
-// New creates a new 10MinuteMail session with a random address.
-func New() (*Session, error) {
-	s := &Session{
-		baseurl: baseURL,
-		c: &http.Client{
-			Timeout: DefaultTimeout,
-			Transport: &http.Transport{
-				DialTLS: func(network, addr string) (net.Conn, error) {
-					conn, err := net.Dial(network, addr)
-					if err != nil {
-						return nil, err
-					}
-
-					host, _, err := net.SplitHostPort(addr)
-					if err != nil {
-						return nil, err
-					}
-
-					config := &tls.Config{ServerName: host}
-					uconn := tls.UClient(conn, config, tls.HelloCustom)
-					if err := uconn.ApplyPreset(spec); err != nil {
-						return nil, err
-					}
-					if err := uconn.Handshake(); err != nil {
-						return nil, err
-					}
-
-					return uconn, nil
-				},
-			},
-		},
-		// It's better to assume that we have less time than more time.
-		// Assume our mail will expire 10 minutes from initialisation,
-		// before the request is made.
-		lastreset: time.Now(),
+	var origin string
+	if u, err := url.Parse(s.baseurl); err == nil {
+		origin = u.Scheme + "://" + u.Host
 	}
 
-	return newSession(s)
-}
+	referer := s.cfg.referer
+	if referer == "" {
+		referer = origin + "/"
+	}
+	h.Set("Referer", referer)
 
-// NewWithClient is identical to New but allows
-// for passing a custom HTTP client object.
-func NewWithClient(c *http.Client) (*Session, error) {
-	s := &Session{
-		baseurl:   baseURL,
-		c:         c,
-		lastreset: time.Now(),
+	if method == http.MethodPost {
+		h.Set("Origin", origin)
 	}
 
-	return newSession(s)
+	return h
 }
 
-// newSession abstracts the logic of the New function
-// to enable testing.
-func newSession(s *Session) (*Session, error) {
-	u := join(baseURL, endpointAddress)
-	req, err := http.NewRequest(http.MethodGet, u, nil)
-	if err != nil {
-		return s, fmt.Errorf("%w: %s", ErrBuildingRequest, err)
+// do sends req, logging the outcome and recording metrics if configured.
+// endpoint names the API endpoint being called, for logging.
+func (s *Session) do(req *http.Request, endpoint string) (*http.Response, error) {
+	if s.cfg.limiter != nil {
+		if err := s.wait(req.Context()); err != nil {
+			return nil, err
+		}
 	}
 
-	req.Header = s.headers()
+	req, traced := s.traceRequest(req, endpoint)
 
-	// Initialise session
+	start := time.Now()
 	res, err := s.c.Do(req)
-	if err != nil {
-		return s, fmt.Errorf("%w: %s", ErrRequestFailed, err)
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode == http.StatusForbidden {
-		return s, ErrBlockedByServer
-	}
-
-	// Read body
-	b, err := io.ReadAll(res.Body)
-	if err != nil {
-		return s, fmt.Errorf("%w: %s", ErrReadBody, err)
-	}
 
-	// Store session cookie
-	for _, cookie := range res.Cookies() {
-		if cookie.Name == "JSESSIONID" {
-			s.token = cookie.Value
-		}
+	d := time.Since(start)
+	traced(res, err)
+	s.stats.observe(start, d, err != nil || res.StatusCode >= 400)
+	if err == nil {
+		s.rotateToken(req, res)
 	}
-	if s.token == "" {
-		return s, ErrMissingSession
+	if s.cfg.logger != nil {
+		s.logRequest(req, endpoint, res, err, d)
 	}
-
-	// Store address
-	v := &internal.AddressResponse{}
-	err = json.Unmarshal(b, v)
-	if err != nil {
-		return s, fmt.Errorf("%w: %s", ErrUnmarshalFailed, err)
+	if s.cfg.metrics != nil {
+		s.cfg.metrics.observe(endpoint, res, err, d)
 	}
-	s.address = v.Address
 
-	return s, nil
+	return res, err
 }
 
-// Address returns the email address attached to the current session.
-func (s *Session) Address() string {
-	return s.address
+// authCookie returns the cookie holding the session token,
+// to be attached to requests.
+func (s *Session) authCookie() *http.Cookie {
+	return &http.Cookie{
+		Name:   "JSESSIONID",
+		Value:  s.sessionToken(),
+		MaxAge: s.cfg.cookieMaxAge,
+	}
 }
 
-// Expired returns whether or not the session is due to have expired
-// and is in need of renewal.
-func (s *Session) Expired() bool {
-	return !time.Now().Before(s.lastreset.Add(10 * time.Minute))
-}
+// sessionToken returns the current session token.
+func (s *Session) sessionToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-// ExpiresAt returns a time.Time object representing the instant
-// in time that the session is due to expire.
-func (s *Session) ExpiresAt() time.Time {
-	return s.lastreset.Add(10 * time.Minute)
+	return s.token
 }
 
-// Messages contacts the server and returns a list of all messages
-// received to the email address attached to this session.
-//
-// Note that if any new messages are found, the same counter will
-// be updated that is used when calling the session.Latest() method,
-// so you won't need to call it afterwards.
-func (s *Session) Messages() ([]Message, error) {
-	return s.messages(0)
-}
+// rotateToken switches to the new session token if the server sent
+// one in response to req, so the next request uses it.
+func (s *Session) rotateToken(req *http.Request, res *http.Response) {
+	if len(res.Header["Set-Cookie"]) == 0 {
+		return
+	}
 
-// Latest contacts the server and returns a list of any messages
-// that haven't already been received by this session.
-func (s *Session) Latest() ([]Message, error) {
-	return s.messages(s.lastcount)
+	// Ignore cookies from other sites, such as followed links
+	if u, err := url.Parse(s.baseurl); err != nil || u.Host != req.URL.Host {
+		return
+	}
+
+	// Ignore responses to requests made with another token, such as
+	// the one checked by SetToken
+	var sent string
+	if c, err := req.Cookie("JSESSIONID"); err == nil {
+		sent = c.Value
+	}
+
+	for _, c := range res.Cookies() {
+		if c.Name == "JSESSIONID" && c.Value != "" {
+			s.mu.Lock()
+			if s.token == sent {
+				s.token = c.Value
+			}
+			s.mu.Unlock()
+		}
+	}
 }
 
-func (s *Session) messages(i int64) ([]Message, error) {
-	var m []Message
+// wait blocks until the rate limiter allows another request. It fails
+// immediately if the wait would outlast ctx or the client timeout.
+func (s *Session) wait(ctx context.Context) error {
+	if s.c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.c.Timeout)
+		defer cancel()
+	}
 
-	// Prepare request
-	u := join(s.baseurl, endpointMessagesAfter, strconv.FormatInt(i, 10))
-	req, err := http.NewRequest(http.MethodGet, u, nil)
-	if err != nil {
-		return m, fmt.Errorf("%w: %s", ErrBuildingRequest, err)
+	if err := s.cfg.limiter.Wait(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrRateLimited, err)
 	}
 
-	req.Header = s.headers()
+	return nil
+}
 
-	// Attach token
-	req.AddCookie(&http.Cookie{
-		Name:   "JSESSIONID",
-		Value:  s.token,
-		MaxAge: 300,
-	})
+// logRequest logs the outcome of a request made by do.
+func (s *Session) logRequest(req *http.Request, endpoint string, res *http.Response, err error, d time.Duration) {
+	l := s.cfg.logger.With(
+		slog.String("method", req.Method),
+		slog.String("endpoint", endpoint),
+		slog.Duration("duration", d),
+	)
 
-	// Make request
-	res, err := s.c.Do(req)
 	if err != nil {
-		return m, fmt.Errorf("%w: %s", ErrRequestFailed, err)
+		l.Debug("request failed", slog.Any("error", err))
+		return
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode == http.StatusForbidden {
-		return m, ErrBlockedByServer
+	switch res.StatusCode {
+	case http.StatusForbidden, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		l.Warn("request blocked by server", slog.Int("status", res.StatusCode))
+	default:
+		l.Debug("request completed", slog.Int("status", res.StatusCode))
 	}
+}
 
-	// Read body
-	b, err := io.ReadAll(res.Body)
+// New creates a new 10MinuteMail session with a random address.
+func New(opts ...Option) (*Session, error) {
+	cfg, err := newConfig(opts)
 	if err != nil {
-		return m, fmt.Errorf("%w: %s", ErrReadBody, err)
+		return nil, err
 	}
 
-	// Unmarshal response
-	err = json.Unmarshal(b, &m)
-	if err != nil {
-		return m, fmt.Errorf("%w: %s", ErrUnmarshalFailed, err)
+	s := &Session{
+		baseurl: cfg.baseURL,
+		c:       newClient(cfg),
+		cfg:     cfg,
+		// It's better to assume that we have less time than more time.
+		// Assume our mail will expire 10 minutes from initialisation,
+		// before the request is made.
+		lastreset: time.Now(),
 	}
 
-	// Update last received counter
-	s.lastcount = i + int64(len(m))
-
-	return m, nil
+	return newSession(s)
 }
 
-// Renew attempts to extend the session by an additional 10 minutes.
+// NewWithClient is identical to New but allows
+// for passing a custom HTTP client object.
 //
-// Returns a bool indicating whether the server indicated that the
-// reset was successful or not and an error if issues were encountered
-// while making the request.
-func (s *Session) Renew() (bool, error) {
-	// If our reset was successful, assume that we have
-	// 10 minutes from when this routine began, to be safe.
-	resetAt := time.Now()
-
-	// Prepare request
-	u := join(s.baseurl, endpointReset)
-	req, err := http.NewRequest(http.MethodGet, u, nil)
+// Options that configure the HTTP client or its transport,
+// such as WithTimeout and WithProxy, are ignored.
+func NewWithClient(c *http.Client, opts ...Option) (*Session, error) {
+	cfg, err := newConfig(opts)
 	if err != nil {
-		return false, fmt.Errorf("%w: %s", ErrBuildingRequest, err)
+		return nil, err
 	}
 
-	req.Header = s.headers()
+	s := &Session{
+		baseurl:   cfg.baseURL,
+		c:         c,
+		cfg:       cfg,
+		lastreset: time.Now(),
+	}
 
-	// Attach token
-	req.AddCookie(&http.Cookie{
-		Name:   "JSESSIONID",
-		Value:  s.token,
-		MaxAge: 300,
-	})
+	return newSession(s)
+}
 
-	// Make request
-	res, err := s.c.Do(req)
+// NewWithDomain is like New, but creates sessions until it gets an
+// address on domain, such as "example.com". 10MinuteMail hands out
+// addresses on several domains, some of which may be blocked by the
+// service you're signing up to.
+//
+// ErrDomainUnavailable is returned if no address on domain is handed
+// out after several attempts.
+func NewWithDomain(domain string, opts ...Option) (*Session, error) {
+	cfg, err := newConfig(opts)
 	if err != nil {
-		return false, fmt.Errorf("%w: %s", ErrRequestFailed, err)
+		return nil, err
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode == http.StatusForbidden {
-		return false, ErrBlockedByServer
-	}
+	c := newClient(cfg)
+	for i := 0; i < domainAttempts; i++ {
+		s, err := newSession(&Session{
+			baseurl:   cfg.baseURL,
+			c:         c,
+			cfg:       cfg,
+			lastreset: time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
 
-	// Read body
-	b, err := io.ReadAll(res.Body)
-	if err != nil {
-		return false, fmt.Errorf("%w: %s", ErrReadBody, err)
+		_, d, _ := strings.Cut(s.Address(), "@")
+		if strings.EqualFold(d, domain) {
+			return s, nil
+		}
 	}
 
-	// Unmarshal response
-	v := &internal.ResetResponse{}
-	err = json.Unmarshal(b, v)
+	return nil, fmt.Errorf("%w: %s after %d attempts", ErrDomainUnavailable, domain, domainAttempts)
+}
+
+// NewFromToken resumes an existing 10MinuteMail session using the
+// value of its JSESSIONID cookie, looking up the attached address.
+//
+// The session's expiry can't be recovered from the token alone, so
+// it is assumed to have been reset just before this call.
+func NewFromToken(token string, opts ...Option) (*Session, error) {
+	cfg, err := newConfig(opts)
 	if err != nil {
-		return false, fmt.Errorf("%w: %s", ErrUnmarshalFailed, err)
+		return nil, err
 	}
 
-	// As far as I know, this string indicates success
-	if v.Response != "reset" {
-		return false, nil
+	s := &Session{
+		token:     token,
+		baseurl:   cfg.baseURL,
+		c:         newClient(cfg),
+		cfg:       cfg,
+		lastreset: time.Now(),
 	}
 
-	// Update reset time
-	s.lastreset = resetAt
-
-	return true, nil
+	return newSession(s)
 }
 
-// Reply asks 10MinuteMail to send a reply to the email that sent
+// SessionFromToken builds a session from a token and address obtained
+// elsewhere, such as from a browser already using 10MinuteMail. Unlike
+// NewFromToken, no request is made: the credentials are trusted as
+// given, so a bad token only shows up on first use. The address may be
+// empty if it isn't known.
+//
+// As with NewFromToken, the session is assumed to have been reset just
+// before this call. An error wrapping ErrMissingSession is returned if
+// token is empty.
+func SessionFromToken(address, token string, opts ...Option) (*Session, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: empty token", ErrMissingSession)
+	}
+
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		address:   address,
+		token:     token,
+		baseurl:   cfg.baseURL,
+		c:         newClient(cfg),
+		cfg:       cfg,
+		lastreset: time.Now(),
+	}
+	s.createdat = s.lastreset
+	s.stats.createdAt = s.lastreset
+	s.armExpiry()
+
+	return s, nil
+}
+
+// NewWithEnv creates a session configured from the environment:
+//
+//	TMM_USER_AGENT     overrides the User-Agent header
+//	TMM_TIMEOUT        overrides the client timeout, e.g. "30s"
+//	TMM_BASE_URL       overrides the 10MinuteMail server
+//	TMM_PROXY_URL      routes requests through an HTTP proxy
+//	TMM_SESSION_TOKEN  resumes an existing session with NewFromToken
+//
+// Unset variables leave the defaults in place.
+func NewWithEnv() (*Session, error) {
+	var opts []Option
+
+	if v := os.Getenv("TMM_USER_AGENT"); v != "" {
+		opts = append(opts, WithUserAgent(v))
+	}
+	if v := os.Getenv("TMM_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: TMM_TIMEOUT: %w", ErrInvalidOption, err)
+		}
+		opts = append(opts, WithTimeout(d))
+	}
+	if v := os.Getenv("TMM_BASE_URL"); v != "" {
+		opts = append(opts, WithBaseURL(v))
+	}
+	if v := os.Getenv("TMM_PROXY_URL"); v != "" {
+		opts = append(opts, WithProxy(v))
+	}
+
+	if token := os.Getenv("TMM_SESSION_TOKEN"); token != "" {
+		return NewFromToken(token, opts...)
+	}
+
+	return New(opts...)
+}
+
+// CheckConnectivity connects to the server with the given options and
+// requests its home page, without creating a session. It returns
+// ErrBlockedByServer if the request is refused, which usually means
+// the TLS fingerprint is no longer accepted by Cloudflare.
+//
+// This is useful for health checks, and for testing a change to the
+// fingerprint without using up addresses.
+func CheckConnectivity(opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	s := &Session{
+		baseurl: cfg.baseURL,
+		c:       newClient(cfg),
+		cfg:     cfg,
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.baseurl, nil)
+	if err != nil {
+		return &RequestError{Kind: ErrBuildingRequest, URL: s.baseurl, Err: err}
+	}
+
+	req.Header = s.headers(req.Method)
+
+	res, err := s.do(req, "/")
+	if err != nil {
+		return &RequestError{Kind: ErrRequestFailed, URL: s.baseurl, Err: err}
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusForbidden,
+		res.StatusCode == http.StatusTooManyRequests,
+		res.StatusCode == http.StatusServiceUnavailable:
+		return &StatusError{Kind: ErrBlockedByServer, URL: s.baseurl, StatusCode: res.StatusCode}
+	case res.StatusCode >= 400:
+		return &StatusError{Kind: ErrRequestFailed, URL: s.baseurl, StatusCode: res.StatusCode}
+	}
+
+	return nil
+}
+
+// newSession abstracts the logic of the New function
+// to enable testing.
+func newSession(s *Session) (*Session, error) {
+	s.stats.createdAt = time.Now()
+
+	for i := 0; ; i++ {
+		err := s.initialise()
+		if err == nil {
+			s.createdat = time.Now()
+		}
+		if err == nil || i >= s.cfg.initRetries || !incomplete(err) {
+			return s, err
+		}
+
+		time.Sleep(initRetryDelay)
+	}
+}
+
+// incomplete reports whether err means the server accepted a request to
+// create a session but left out the cookie or address, which happens
+// when it's under heavy load.
+func incomplete(err error) bool {
+	var serr *StatusError
+	return errors.As(err, &serr) && serr.Kind == ErrMissingSession && serr.StatusCode == http.StatusOK
+}
+
+// initialise requests the session's token and address.
+func (s *Session) initialise() error {
+	a, err := s.requestAddress(s.sessionToken())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.token, s.cookies = a.token, a.cookies
+	s.addrres = a.res
+	s.mu.Unlock()
+	s.setAddress(a.res.Address)
+	s.armExpiry()
+
+	return nil
+}
+
+// addressResult holds the state of a session returned by the server
+// in response to an address request.
+type addressResult struct {
+	token   string
+	cookies []*http.Cookie
+	res     *AddressResponse
+}
+
+// requestAddress makes an address request, resuming the session with
+// token if it isn't empty, without changing the state of s. An error
+// wrapping ErrMissingSession is returned if the response lacks either
+// the token or the address.
+func (s *Session) requestAddress(token string) (*addressResult, error) {
+	u := join(s.baseurl, endpointAddress)
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, &RequestError{Kind: ErrBuildingRequest, URL: u, Err: err}
+	}
+
+	req.Header = s.headers(req.Method)
+
+	// Attach token if we're resuming a session
+	if token != "" {
+		c := s.authCookie()
+		c.Value = token
+		req.AddCookie(c)
+	}
+
+	// Initialise session
+	res, err := s.do(req, endpointAddress)
+	if err != nil {
+		return nil, &RequestError{Kind: ErrRequestFailed, URL: u, Err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusForbidden {
+		return nil, &StatusError{Kind: ErrBlockedByServer, URL: u, StatusCode: res.StatusCode}
+	}
+
+	// Read body
+	b, err := s.readBody(res)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find session cookie
+	a := &addressResult{token: token, cookies: res.Cookies()}
+	for _, cookie := range a.cookies {
+		if cookie.Name == "JSESSIONID" {
+			a.token = cookie.Value
+		}
+	}
+	if a.token == "" {
+		cookies := "no cookies"
+		if n := len(a.cookies); n > 0 {
+			cookies = fmt.Sprintf("%d other cookies", n)
+		}
+		return nil, &StatusError{Kind: ErrMissingSession, URL: u, StatusCode: res.StatusCode, Detail: cookies}
+	}
+
+	// Find address
+	a.res, err = parseAddressResponse(b)
+	if err != nil {
+		return nil, err
+	}
+	if a.res.Address == "" {
+		return nil, &StatusError{Kind: ErrMissingSession, URL: u, StatusCode: res.StatusCode, Detail: "no address"}
+	}
+
+	return a, nil
+}
+
+// Address returns the email address attached to the current session.
+func (s *Session) Address() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.address
+}
+
+// WithAddress overrides the address of the session with address,
+// without contacting the server or calling the address change hook.
+// It is meant for tests that need a known address; the server still
+// delivers mail to the session's real address, so it shouldn't be
+// used in production.
+func (s *Session) WithAddress(address string) {
+	s.mu.Lock()
+	s.address = address
+	s.mu.Unlock()
+}
+
+// setAddress records the address the server reports for the session,
+// calling the address change hook if it differs from the one known.
+func (s *Session) setAddress(addr string) {
+	s.mu.Lock()
+	old := s.address
+	s.address = addr
+	s.mu.Unlock()
+
+	s.addressChanged(old, addr)
+}
+
+// addressChanged calls the address change hook if the address changed
+// from old to addr. It mustn't be called holding fetchmu or mu, as the
+// hook may use the session.
+func (s *Session) addressChanged(old, addr string) {
+	if old != "" && old != addr && s.cfg.onAddressChange != nil {
+		s.cfg.onAddressChange(old, addr)
+	}
+}
+
+// Equal reports whether s and other refer to the same session in the
+// same state: the same address, token, expiry and message counter.
+// The tokens are compared in constant time.
+func (s *Session) Equal(other *Session) bool {
+	if s == other {
+		return true
+	}
+	if s == nil || other == nil {
+		return false
+	}
+
+	s.fetchmu.Lock()
+	s.mu.Lock()
+	address, lastreset, lastcount, token := s.address, s.lastreset, s.lastcount, s.token
+	s.mu.Unlock()
+	s.fetchmu.Unlock()
+
+	other.fetchmu.Lock()
+	other.mu.Lock()
+	defer other.fetchmu.Unlock()
+	defer other.mu.Unlock()
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(other.token)) == 1 &&
+		address == other.address &&
+		lastreset.Equal(other.lastreset) &&
+		lastcount == other.lastcount
+}
+
+// SameMailbox reports whether s and other are attached to the same
+// email address, regardless of the rest of their state.
+func (s *Session) SameMailbox(other *Session) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+
+	return s.Address() == other.Address()
+}
+
+// RawAddressResponse returns the response the server gave when the
+// session was created, including any fields not otherwise exposed.
+// It returns nil if the session wasn't created by this package.
+func (s *Session) RawAddressResponse() *AddressResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.addrres == nil {
+		return nil
+	}
+
+	v := &AddressResponse{
+		Address: s.addrres.Address,
+		Fields:  make(map[string]json.RawMessage, len(s.addrres.Fields)),
+	}
+	for k, f := range s.addrres.Fields {
+		v.Fields[k] = f
+	}
+
+	return v
+}
+
+// SessionExport holds the state needed to resume a session, as
+// returned by Session.Export.
+type SessionExport struct {
+	Token     string    `json:"token"`
+	Address   string    `json:"address"`
+	LastReset time.Time `json:"lastReset"`
+	LastCount int64     `json:"lastCount"`
+}
+
+// Export returns the mailbox state of the session - its token,
+// address, expiry and message counter - for storing elsewhere, such
+// as in a configuration system. Restore it with Import.
+func (s *Session) Export() SessionExport {
+	s.fetchmu.Lock()
+	s.mu.Lock()
+	e := SessionExport{
+		Token:     s.token,
+		Address:   s.address,
+		LastReset: s.lastreset,
+		LastCount: s.lastcount,
+	}
+	s.mu.Unlock()
+	s.fetchmu.Unlock()
+
+	return e
+}
+
+// Import replaces the mailbox state of the session with e, as returned
+// by Export, without contacting the server. Messages and cookies kept
+// from the old mailbox are dropped. The receiver keeps its own HTTP
+// client and options. An error wrapping ErrMissingSession is returned
+// if e has no token.
+func (s *Session) Import(e SessionExport) error {
+	if e.Token == "" {
+		return fmt.Errorf("%w: empty token", ErrMissingSession)
+	}
+
+	s.fetchmu.Lock()
+	s.mu.Lock()
+	s.resetMailbox()
+	s.address, s.lastreset, s.lastcount = e.Address, e.LastReset, e.LastCount
+	s.token = e.Token
+	s.mu.Unlock()
+	s.fetchmu.Unlock()
+
+	s.armExpiry()
+
+	return nil
+}
+
+// SetToken switches the session to token, such as one refreshed from
+// a cookie store. The token is checked by looking up its address
+// first, and the session is left unchanged if that fails. As with
+// NewFromToken, the session is assumed to have been reset just before
+// this call. If the token belongs to a different mailbox, the address
+// change hook is called, the message counter starts over and messages
+// kept from the old mailbox are dropped.
+func (s *Session) SetToken(token string) error {
+	if token == "" {
+		return fmt.Errorf("%w: empty token", ErrMissingSession)
+	}
+
+	a, err := s.requestAddress(token)
+	if err != nil {
+		return err
+	}
+
+	s.fetchmu.Lock()
+	s.mu.Lock()
+	old := s.address
+	if a.res.Address != old {
+		s.resetMailbox()
+		s.lastcount = 0
+	}
+	s.address, s.lastreset = a.res.Address, time.Now()
+	s.token, s.cookies = a.token, a.cookies
+	s.addrres = a.res
+	s.mu.Unlock()
+	s.fetchmu.Unlock()
+
+	s.armExpiry()
+	s.addressChanged(old, a.res.Address)
+
+	return nil
+}
+
+// Copy replaces the mailbox state of the session - its address, token,
+// cookies, expiry and message counter - with that of src, and restarts
+// the expiry timer. Messages kept from the old mailbox, such as those
+// buffered by Next, are dropped. The receiver keeps its own HTTP client
+// and options.
+func (s *Session) Copy(src *Session) error {
+	if src == nil {
+		return ErrNilSession
+	}
+	if src == s {
+		return nil
+	}
+
+	src.fetchmu.Lock()
+	src.mu.Lock()
+	address, lastreset, lastcount := src.address, src.lastreset, src.lastcount
+	token, addrres := src.token, src.addrres
+	cookies := append([]*http.Cookie(nil), src.cookies...)
+	last := append([]Message(nil), src.last...)
+	src.mu.Unlock()
+	src.fetchmu.Unlock()
+
+	s.fetchmu.Lock()
+	s.mu.Lock()
+	s.resetMailbox()
+	s.address, s.lastreset, s.lastcount = address, lastreset, lastcount
+	s.token, s.addrres = token, addrres
+	s.cookies, s.last = cookies, last
+	s.mu.Unlock()
+	s.fetchmu.Unlock()
+
+	s.armExpiry()
+
+	return nil
+}
+
+// resetMailbox drops the messages kept from the session's mailbox, for
+// when it is switched to another one. Must be called holding fetchmu
+// and mu.
+func (s *Session) resetMailbox() {
+	s.cookies, s.last, s.pending, s.seen = nil, nil, nil, nil
+}
+
+// ExportCookies returns copies of the cookies the server set for this
+// session, including JSESSIONID, so the session can be handed off to
+// another HTTP client such as a headless browser. Cookies without a
+// domain are given the domain of the 10MinuteMail server.
+func (s *Session) ExportCookies() []*http.Cookie {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	host := ""
+	if u, err := url.Parse(s.baseurl); err == nil {
+		host = u.Hostname()
+	}
+
+	var cookies []*http.Cookie
+	hasToken := false
+	for _, c := range s.cookies {
+		cp := *c
+		cp.Unparsed = append([]string(nil), c.Unparsed...)
+		if cp.Name == "JSESSIONID" {
+			cp.Value = s.token
+			hasToken = true
+		}
+		if cp.Domain == "" {
+			cp.Domain = host
+		}
+		cookies = append(cookies, &cp)
+	}
+
+	// Sessions resumed from a token may not have been sent it again
+	if !hasToken && s.token != "" {
+		cookies = append(cookies, &http.Cookie{
+			Name:   "JSESSIONID",
+			Value:  s.token,
+			Domain: host,
+			Path:   "/",
+			MaxAge: s.cfg.cookieMaxAge,
+		})
+	}
+
+	return cookies
+}
+
+// Expired returns whether or not the session is due to have expired
+// and is in need of renewal.
+func (s *Session) Expired() bool {
+	return !time.Now().Before(s.ExpiresAt())
+}
+
+// CreatedAt returns the time the session was created, when the server
+// handed out its address. Unlike the expiry, it isn't changed by
+// renewing the session.
+func (s *Session) CreatedAt() time.Time {
+	return s.createdat
+}
+
+// ExpiresAt returns a time.Time object representing the instant
+// in time that the session is due to expire.
+func (s *Session) ExpiresAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastreset.Add(10 * time.Minute)
+}
+
+// Done returns a channel that's closed when the session expires,
+// for use in select statements. A successful Renew pushes the
+// expiry back; if the session had already expired, a new channel
+// is returned by subsequent calls.
+func (s *Session) Done() <-chan struct{} {
+	s.expmu.Lock()
+	defer s.expmu.Unlock()
+
+	if s.done == nil {
+		s.done = make(chan struct{})
+		if s.exptimer == nil {
+			s.exptimer = time.AfterFunc(time.Until(s.ExpiresAt()), s.expire)
+		}
+	}
+
+	return s.done
+}
+
+// WaitForExpiry blocks until the session expires, returning nil, or
+// until ctx is done, returning ctx.Err(). Renewing the session while
+// waiting pushes the expiry back, as with Done.
+func (s *Session) WaitForExpiry(ctx context.Context) error {
+	select {
+	case <-s.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// armExpiry (re)starts the timer that closes the Done channel,
+// based on the current expiry time.
+func (s *Session) armExpiry() {
+	s.expmu.Lock()
+	defer s.expmu.Unlock()
+
+	if s.exptimer != nil {
+		s.exptimer.Stop()
+	}
+
+	// A renewed session gets a fresh channel if the old one had closed
+	if s.done != nil {
+		select {
+		case <-s.done:
+			s.done = make(chan struct{})
+		default:
+		}
+	}
+
+	s.exptimer = time.AfterFunc(time.Until(s.ExpiresAt()), s.expire)
+}
+
+// OnExpiry registers fn to be called in a new goroutine when the
+// session expires. If the session has already expired, fn is called
+// straight away. A successful Renew pushes the call back to the new
+// expiry time. Any number of functions may be registered.
+func (s *Session) OnExpiry(fn func()) {
+	s.expmu.Lock()
+	defer s.expmu.Unlock()
+
+	s.onexpiry = append(s.onexpiry, fn)
+
+	if s.Expired() {
+		go fn()
+	} else if s.exptimer == nil {
+		s.exptimer = time.AfterFunc(time.Until(s.ExpiresAt()), s.expire)
+	}
+}
+
+// expire closes the Done channel and runs the OnExpiry functions.
+// Called by the expiry timer.
+func (s *Session) expire() {
+	s.expmu.Lock()
+	defer s.expmu.Unlock()
+
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+
+	for _, fn := range s.onexpiry {
+		go fn()
+	}
+}
+
+// checkExpired returns ErrSessionExpired if the session has expired
+// and the expiry guard is enabled.
+func (s *Session) checkExpired() error {
+	if s.cfg.expiryGuard && s.Expired() {
+		return fmt.Errorf("%w at %s", ErrSessionExpired, s.ExpiresAt().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Messages contacts the server and returns a list of all messages
+// received to the email address attached to this session.
+//
+// ErrSessionExpired is returned without making a request if the
+// session has expired, unless disabled with WithExpiryGuard.
+//
+// Note that if any new messages are found, the same counter will
+// be updated that is used when calling the session.Latest() method,
+// so you won't need to call it afterwards.
+func (s *Session) Messages() ([]Message, error) {
+	s.acquire()
+	defer s.release()
+
+	m, err := s.messages(0)
+	if s.cfg.dedup {
+		// Everything is returned, but remember it so
+		// Latest won't return it again.
+		for _, msg := range m {
+			s.seenSet().add(msg.ID)
+		}
+	}
+
+	return m, err
+}
+
+// MessagesLimit is like Messages, but returns at most the n most
+// recently sent messages, newest first. Older messages are never
+// downloaded, which keeps memory use bounded if the mailbox is being
+// flooded.
+//
+// Messages older than those returned are treated as received, so they
+// won't be returned by a later call to Latest.
+func (s *Session) MessagesLimit(n int) ([]Message, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	s.acquire()
+	defer s.release()
+
+	count, err := s.MessageCount()
+	if err != nil {
+		return nil, err
+	}
+
+	skip := count - int64(n)
+	if skip < 0 {
+		skip = 0
+	}
+
+	m, err := s.messages(skip)
+	if err != nil {
+		return nil, err
+	}
+
+	// More may have arrived since counting; keep the newest.
+	sort.SliceStable(m, func(i, j int) bool {
+		return m[i].SentDate.After(m[j].SentDate)
+	})
+	if len(m) > n {
+		m = m[:n]
+	}
+
+	if s.cfg.dedup {
+		for _, msg := range m {
+			s.seenSet().add(msg.ID)
+		}
+	}
+
+	return m, nil
+}
+
+// MessageCount asks the server how many messages are in the mailbox.
+func (s *Session) MessageCount() (int64, error) {
+	v := &internal.MessageCountResponse{}
+	if err := s.getJSON(v, endpointMessageCount); err != nil {
+		return 0, err
+	}
+
+	return v.MessageCount, nil
+}
+
+// Latest contacts the server and returns a list of any messages
+// that haven't already been received by this session.
+//
+// Concurrent calls to Latest and Messages are run one at a time.
+func (s *Session) Latest() ([]Message, error) {
+	s.acquire()
+	defer s.release()
+
+	m, err := s.messages(s.lastcount)
+	return s.dedupe(m), err
+}
+
+// MessagesAfter returns the messages received after the first cursor
+// messages, along with the cursor to pass to the next call. Unlike
+// Latest, the session's own counter is left alone, so the caller can
+// choose when to advance the cursor: only once the messages have been
+// handled for at-least-once processing, or straight away for
+// at-most-once. A cursor of zero returns every message.
+//
+// On error the cursor is returned unchanged.
+func (s *Session) MessagesAfter(cursor int64) ([]Message, int64, error) {
+	if cursor < 0 {
+		cursor = 0
+	}
+
+	m, err := s.list(cursor)
+	if err != nil {
+		return nil, cursor, err
+	}
+	s.stats.addMessages(len(m))
+
+	return m, cursor + int64(len(m)), nil
+}
+
+// TryLatest is like Latest, but returns immediately if another call
+// to Latest or Messages is already in progress rather than waiting
+// for it to finish.
+//
+// The returned bool reports whether the fetch was actually made.
+func (s *Session) TryLatest() ([]Message, bool, error) {
+	s.mu.Lock()
+	if s.inflight > 0 {
+		s.mu.Unlock()
+		return nil, false, nil
+	}
+	s.inflight++
+	s.mu.Unlock()
+
+	s.fetchmu.Lock()
+	defer s.release()
+
+	m, err := s.messages(s.lastcount)
+	return s.dedupe(m), true, err
+}
+
+// dedupe removes any messages that have already been returned,
+// if deduplication is enabled. Must be called holding fetchmu.
+func (s *Session) dedupe(m []Message) []Message {
+	if !s.cfg.dedup || len(m) == 0 {
+		return m
+	}
+
+	seen := s.seenSet()
+	var fresh []Message
+	for _, msg := range m {
+		if seen.add(msg.ID) {
+			fresh = append(fresh, msg)
+		}
+	}
+
+	return fresh
+}
+
+// seenSet returns the set of seen message IDs, creating it if needed.
+// Must be called holding fetchmu.
+func (s *Session) seenSet() *seenSet {
+	if s.seen == nil {
+		s.seen = newSeenSet(dedupSize)
+	}
+
+	return s.seen
+}
+
+// acquire blocks until the session is free to fetch messages.
+func (s *Session) acquire() {
+	s.mu.Lock()
+	s.inflight++
+	s.mu.Unlock()
+
+	s.fetchmu.Lock()
+}
+
+// release marks the current fetch as finished.
+func (s *Session) release() {
+	s.fetchmu.Unlock()
+
+	s.mu.Lock()
+	s.inflight--
+	s.mu.Unlock()
+}
+
+// Receive waits for a new message containing a match for pattern and
+// returns the match, polling for new messages every pollInterval until
+// ctx is done. A pollInterval of zero or less polls at the same rate
+// as Next.
+//
+// The session is renewed automatically when it is close to expiry.
+// One which has already expired can't be renewed, so ErrSessionExpired
+// is returned straight away unless disabled with WithExpiryGuard.
+//
+// See Message.Extract for how the match is chosen.
+func (s *Session) Receive(ctx context.Context, pattern *regexp.Regexp, pollInterval time.Duration) (string, error) {
+	tk := time.NewTicker(defaultInterval(pollInterval))
+	defer tk.Stop()
+
+	for {
+		// Renew if we're about to expire
+		if time.Until(s.ExpiresAt()) < renewThreshold {
+			ok, err := s.Renew()
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				return "", ErrRenewRejected
+			}
+		}
+
+		mail, err := s.Latest()
+		if err != nil {
+			return "", err
+		}
+
+		for _, m := range mail {
+			if match, ok := m.Extract(pattern); ok {
+				return match, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-tk.C:
+		}
+	}
+}
+
+// nextInterval is how often Next polls for new messages.
+var nextInterval = 5 * time.Second
+
+// defaultInterval returns the polling interval d, or nextInterval if
+// it is zero or less.
+func defaultInterval(d time.Duration) time.Duration {
+	if d <= 0 {
+		return nextInterval
+	}
+
+	return d
+}
+
+// Next waits for the next new message and returns it, polling every
+// few seconds until ctx is done. If a poll finds several messages, the
+// earliest sent is returned and the rest are kept for the following
+// calls to Next, which return them in the order they were sent without
+// polling.
+//
+// Next fetches with Latest, so a message is returned by one or the
+// other, not both.
+func (s *Session) Next(ctx context.Context) (Message, error) {
+	t := time.NewTimer(0)
+	defer t.Stop()
+
+	for {
+		s.mu.Lock()
+		if len(s.pending) > 0 {
+			m := s.pending[0]
+			s.pending = s.pending[1:]
+			s.mu.Unlock()
+			return m, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-t.C:
+		}
+
+		mail, err := s.Latest()
+		if err != nil {
+			return Message{}, err
+		}
+
+		sort.SliceStable(mail, func(i, j int) bool {
+			return mail[i].SentDate.Before(mail[j].SentDate)
+		})
+
+		s.mu.Lock()
+		s.pending = append(s.pending, mail...)
+		s.mu.Unlock()
+
+		t.Reset(nextInterval)
+	}
+}
+
+// messages fetches the messages after the i-th and advances the
+// last received counter past them.
+func (s *Session) messages(i int64) ([]Message, error) {
+	m, err := s.list(i)
+	if err != nil {
+		return m, err
+	}
+
+	// Update last received counter
+	s.lastcount = i + int64(len(m))
+	s.stats.addMessages(len(m))
+
+	if n := s.cfg.maxMessages; n > 0 && len(m) > n {
+		m = mostRecent(m, n)
+	}
+
+	s.mu.Lock()
+	s.last = m
+	s.mu.Unlock()
+
+	return m, nil
+}
+
+// mostRecent returns the n most recently sent messages in m,
+// keeping the order they were given in.
+func mostRecent(m []Message, n int) []Message {
+	idx := make([]int, len(m))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return m[idx[i]].SentDate.After(m[idx[j]].SentDate)
+	})
+
+	keep := idx[:n]
+	sort.Ints(keep)
+
+	recent := make([]Message, n)
+	for i, j := range keep {
+		recent[i] = m[j]
+	}
+
+	return recent
+}
+
+// LastMessagesSnapshot returns a copy of the messages returned by the
+// most recent call to Messages, Latest or TryLatest, without contacting
+// the server.
+func (s *Session) LastMessagesSnapshot() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last == nil {
+		return nil
+	}
+
+	// Messages hold no references, so a shallow copy is a deep one.
+	snapshot := make([]Message, len(s.last))
+	copy(snapshot, s.last)
+
+	return snapshot
+}
+
+// list fetches the messages after the i-th without touching
+// the last received counter.
+func (s *Session) list(i int64) ([]Message, error) {
+	var m []Message
+
+	if err := s.checkExpired(); err != nil {
+		return m, err
+	}
+
+	// Prepare request
+	req, err := s.pollRequest(i)
+	if err != nil {
+		return m, &RequestError{Kind: ErrBuildingRequest, URL: s.baseurl, Err: err}
+	}
+
+	// Make request
+	res, err := s.do(req, endpointMessagesAfter)
+	if err != nil {
+		return m, &RequestError{Kind: ErrRequestFailed, URL: req.URL.String(), Err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusForbidden {
+		return m, &StatusError{Kind: ErrBlockedByServer, URL: req.URL.String(), StatusCode: res.StatusCode}
+	}
+	if res.StatusCode == http.StatusNoContent {
+		return []Message{}, nil
+	}
+
+	// Read body
+	b, err := s.readBody(res)
+	if err != nil {
+		return m, err
+	}
+
+	return ParseMessages(b)
+}
+
+// pollTemplate holds the parts of the request made by list which are
+// the same on every call. Polling is by far the most common request,
+// so they're worked out once per session rather than each time.
+type pollTemplate struct {
+	once   sync.Once
+	url    url.URL
+	header http.Header
+	err    error
+}
+
+// pollRequest returns the request for the messages after the i-th,
+// built from the session's poll template.
+func (s *Session) pollRequest(i int64) (*http.Request, error) {
+	t := &s.poll
+	t.once.Do(func() {
+		u, err := url.Parse(s.baseurl)
+		if err != nil {
+			t.err = err
+			return
+		}
+		u.Path = path.Join("/", u.Path, endpointMessagesAfter)
+
+		t.url = *u
+		t.header = s.headers(http.MethodGet)
+	})
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	u := t.url
+	u.Path += "/" + strconv.FormatInt(i, 10)
+
+	// The values are shared, which is safe as headers are only ever
+	// replaced or appended to, never modified in place.
+	h := make(http.Header, len(t.header)+1)
+	for k, v := range t.header {
+		h[k] = v
+	}
+	h["Cookie"] = []string{"JSESSIONID=" + s.sessionToken()}
+
+	return &http.Request{
+		Method:     http.MethodGet,
+		URL:        &u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h,
+		Host:       u.Host,
+	}, nil
+}
+
+// ParseMessages unmarshals a list of messages as returned by the
+// server. The list may be a bare array, null, or wrapped in an object
+// as {"messages": [...]}, and an empty body means there are none. Once
+// a mailbox has been removed the server responds with an error object
+// instead, which is reported as ErrMailboxGone.
+//
+// It is used by the methods fetching messages, and is exported for
+// testing against recorded or malformed responses.
+func ParseMessages(b []byte) ([]Message, error) {
+	var m []Message
+
+	t := bytes.TrimSpace(b)
+	if len(t) == 0 {
+		return []Message{}, nil
+	}
+	if t[0] == '{' {
+		var e struct {
+			Messages json.RawMessage `json:"messages"`
+			Error    string          `json:"error"`
+			Message  string          `json:"message"`
+		}
+		if err := json.Unmarshal(t, &e); err != nil {
+			return m, &RequestError{Kind: ErrUnmarshalFailed, Err: err}
+		}
+
+		switch {
+		case e.Messages != nil:
+			// Wrapped list, parsed below
+			b = e.Messages
+		case e.Message != "":
+			return m, fmt.Errorf("%w: %s", ErrMailboxGone, e.Message)
+		case e.Error != "":
+			return m, fmt.Errorf("%w: %s", ErrMailboxGone, e.Error)
+		default:
+			return m, ErrMailboxGone
+		}
+	}
+
+	// Unmarshal response
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, &RequestError{Kind: ErrUnmarshalFailed, Err: err}
+	}
+
+	return m, nil
+}
+
+// MessageByID returns the message with the provided ID. The messages
+// returned by the most recent fetch are checked first, and only if it
+// isn't among them are the messages fetched again with Messages, which
+// updates the counter used by Latest in the same way.
+//
+// ErrMessageNotFound is returned if there's no such message.
+func (s *Session) MessageByID(id string) (*Message, error) {
+	s.mu.Lock()
+	for _, m := range s.last {
+		if m.ID == id {
+			s.mu.Unlock()
+			return &m, nil
+		}
+	}
+	s.mu.Unlock()
+
+	mail, err := s.Messages()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range mail {
+		if m.ID == id {
+			return &m, nil
+		}
+	}
+
+	return nil, ErrMessageNotFound
+}
+
+// MessageSource returns the message with the provided ID in
+// RFC 5322 form, suitable for saving as a .eml file.
+//
+// 10MinuteMail doesn't expose the raw source of received mail, so
+// this is reconstructed from the parsed fields as with Message.EML,
+// addressed to this session. Original headers and transfer encodings
+// are not preserved.
+func (s *Session) MessageSource(id string) ([]byte, error) {
+	mail, err := s.list(0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range mail {
+		if m.ID == id {
+			return m.eml(s.Address())
+		}
+	}
+
+	return nil, ErrMessageNotFound
+}
+
+// Senders returns the distinct sender addresses of the messages
+// currently in the mailbox, in the order they were first seen.
+// Addresses are normalised to lower case with any display name
+// removed.
+//
+// Unlike Messages, this doesn't affect which messages Latest
+// considers new.
+func (s *Session) Senders() ([]string, error) {
+	mail, err := s.list(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var senders []string
+	seen := make(map[string]bool)
+	for _, m := range mail {
+		addr := normaliseAddress(m.Sender)
+		if !seen[addr] {
+			seen[addr] = true
+			senders = append(senders, addr)
+		}
+	}
+
+	return senders, nil
+}
+
+// SecondsLeft asks the server how many seconds remain
+// before the session expires.
+func (s *Session) SecondsLeft() (int64, error) {
+	v := &internal.SecondsLeftResponse{}
+	if err := s.getJSON(v, endpointSecondsLeft); err != nil {
+		return 0, err
+	}
+
+	return v.SecondsLeft, nil
+}
+
+// Ping checks that the session is still alive on the server.
+//
+// Returns nil if it is, ErrMissingSession if the server no longer
+// recognises it, or an error if the check couldn't be made.
+// It doesn't affect which messages Latest considers new.
+func (s *Session) Ping() error {
+	left, err := s.SecondsLeft()
+	if err != nil {
+		return err
+	}
+
+	if left <= 0 {
+		return fmt.Errorf("%w: server reports session has expired", ErrMissingSession)
+	}
+
+	return nil
+}
+
+// WaitReady blocks until Ping reports the session is alive, retrying
+// with exponential back-off while failures look transient, such as
+// failed requests or the server blocking us.
+//
+// Returns nil once the session is ready, ctx.Err() if ctx is done
+// first, or the first error that isn't transient.
+func (s *Session) WaitReady(ctx context.Context) error {
+	failures := 0
+	for {
+		err := s.Ping()
+		if err == nil {
+			return nil
+		}
+		if !transient(err) {
+			return err
+		}
+
+		failures++
+		t := time.NewTimer(readyBackoff.delay(0, failures))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Search returns the messages in the mailbox that contain query,
+// as described by Match.
+//
+// Unlike Messages, this doesn't affect which messages Latest
+// considers new.
+func (s *Session) Search(query string) ([]Message, error) {
+	mail, err := s.list(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Message
+	for _, m := range mail {
+		if Match(m, query) {
+			found = append(found, m)
+		}
+	}
+
+	return found, nil
+}
+
+// Renew attempts to extend the session by an additional 10 minutes.
+//
+// This calls what 10MinuteMail calls the reset endpoint, which restarts
+// the session's timer rather than allocating a new address; the address
+// is kept. Should the server ever hand back a different address, the
+// session is updated to use it.
+//
+// Returns a bool indicating whether the server indicated that the
+// reset was successful or not and an error if issues were encountered
+// while making the request.
+//
+// An expired session can't be renewed, so ErrSessionExpired is returned
+// without making a request once it has expired, unless disabled with
+// WithExpiryGuard. Renew before ExpiresAt to keep a session alive.
+func (s *Session) Renew() (bool, error) {
+	if err := s.checkExpired(); err != nil {
+		return false, err
+	}
+
+	// If our reset was successful, assume that we have
+	// 10 minutes from when this routine began, to be safe.
+	resetAt := time.Now()
+
+	// Prepare request
+	u := join(s.baseurl, endpointReset)
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return false, &RequestError{Kind: ErrBuildingRequest, URL: u, Err: err}
+	}
+
+	req.Header = s.headers(req.Method)
+
+	// Attach token
+	req.AddCookie(s.authCookie())
+
+	// Make request
+	res, err := s.do(req, endpointReset)
+	if err != nil {
+		return false, &RequestError{Kind: ErrRequestFailed, URL: u, Err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusForbidden {
+		return false, &StatusError{Kind: ErrBlockedByServer, URL: u, StatusCode: res.StatusCode}
+	}
+
+	// Read body
+	b, err := s.readBody(res)
+	if err != nil {
+		return false, err
+	}
+
+	// Unmarshal response
+	v := &internal.ResetResponse{}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return false, &RequestError{Kind: ErrUnmarshalFailed, URL: u, Err: err}
+	}
+
+	// As far as I know, this string indicates success
+	if v.Response != "reset" {
+		return false, nil
+	}
+
+	// Not normally sent, but don't keep using a stale address if it is
+	if v.Address != "" {
+		s.setAddress(v.Address)
+	}
+
+	// Update reset time, keeping the conservative start time but
+	// only restarting the expiry timer now the server has confirmed.
+	s.mu.Lock()
+	s.lastreset = resetAt
+	s.mu.Unlock()
+	s.armExpiry()
+
+	return true, nil
+}
+
+// Refresh re-syncs the session's view of its state with the server,
+// which is useful after a long idle period. It updates:
+//
+//   - the expiry time, from the time the server says is left
+//   - the message counter, to the number of messages in the mailbox
+//
+// Any messages that arrived since the last fetch are treated as
+// received, so later calls to Latest only return newer ones. Fetches
+// wait for Refresh to finish.
+func (s *Session) Refresh() error {
+	s.acquire()
+	defer s.release()
+
+	left, err := s.SecondsLeft()
+	if err != nil {
+		return err
+	}
+	count, err := s.MessageCount()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.lastreset = time.Now().Add(time.Duration(left)*time.Second - 10*time.Minute)
+	s.mu.Unlock()
+	s.lastcount = count
+	s.armExpiry()
+
+	return nil
+}
+
+// RenewIfNeeded renews the session only if it expires within
+// threshold, reporting whether it was renewed. Otherwise no request
+// is made.
+//
+// Since ExpiresAt errs on the side of caution, the server is asked
+// how long is left before renewing, and the renewal is skipped if
+// that turns out to be more than threshold. ErrRenewRejected is
+// returned if the server refuses to renew.
+func (s *Session) RenewIfNeeded(threshold time.Duration) (bool, error) {
+	if time.Until(s.ExpiresAt()) > threshold {
+		return false, nil
+	}
+
+	if left, err := s.SecondsLeft(); err == nil && time.Duration(left)*time.Second > threshold {
+		return false, nil
+	}
+
+	ok, err := s.Renew()
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, ErrRenewRejected
+	}
+
+	return true, nil
+}
+
+// RenewLoop keeps the session alive by renewing it whenever it has
+// beforeExpiry left, until ctx is done or a renewal fails. It blocks,
+// so is usually run in its own goroutine. Each renewal is logged at
+// info level if WithLogger was given.
+//
+// beforeExpiry must be positive and less than the 10 minute lifetime
+// of a session, or an error wrapping ErrInvalidOption is returned
+// without renewing. ErrRenewRejected is returned if the server refuses to
+// renew, and ctx.Err() once ctx is done.
+func (s *Session) RenewLoop(ctx context.Context, beforeExpiry time.Duration) error {
+	if beforeExpiry <= 0 || beforeExpiry >= 10*time.Minute {
+		return fmt.Errorf("%w: renewal window %s is outside the session lifetime", ErrInvalidOption, beforeExpiry)
+	}
+
+	for {
+		t := time.NewTimer(time.Until(s.ExpiresAt().Add(-beforeExpiry)))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		ok, err := s.Renew()
+		if s.cfg.logger != nil {
+			s.cfg.logger.Info("renewing session",
+				slog.String("address", s.Address()),
+				slog.Bool("renewed", ok),
+				slog.Any("error", err),
+			)
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrRenewRejected
+		}
+	}
+}
+
+// Reply asks 10MinuteMail to send a reply to the email that sent
 // the message with the provided ID, with the provided body.
 //
 // Returns a bool indicating whether or not the reply was issued
 // successfully - failure generally means the message is too old -
 // and an error if issues were encountered while making the request.
+// With WithStrictMode, failures are reported as errors instead, with
+// messages that are too old failing with ErrExpiredMessage.
+// ErrSessionExpired is returned without making a request if the
+// session has expired, unless disabled with WithExpiryGuard. Replies
+// are spaced out as configured by WithSendRate.
 func (s *Session) Reply(messageid, body string) (bool, error) {
+	return s.ReplyContext(context.Background(), messageid, body)
+}
+
+// ReplyContext is like Reply, but gives up waiting to send, or on the
+// request itself, once ctx is done.
+func (s *Session) ReplyContext(ctx context.Context, messageid, body string) (bool, error) {
+	if err := s.checkExpired(); err != nil {
+		return false, err
+	}
+	if err := s.waitSend(ctx); err != nil {
+		return false, err
+	}
+
 	// Prepare body
 	reqbody := &internal.ReplyRequest{}
 	reqbody.Reply.MessageID = messageid
@@ -454,41 +2213,29 @@ func (s *Session) Reply(messageid, body string) (bool, error) {
 
 	reqbytes, err := json.Marshal(reqbody)
 	if err != nil {
-		return false, fmt.Errorf("%w: %s", ErrMarshalFailed, err)
+		return false, &RequestError{Kind: ErrMarshalFailed, Err: err}
 	}
 
 	// Prepare request
 	u := join(s.baseurl, endpointMessageReply)
-	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(reqbytes))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(reqbytes))
 	if err != nil {
-		return false, fmt.Errorf("%w: %s", ErrBuildingRequest, err)
+		return false, &RequestError{Kind: ErrBuildingRequest, URL: u, Err: err}
 	}
 
-	req.Header = s.headers()
+	req.Header = s.headers(req.Method)
 
 	// Attach token
-	req.AddCookie(&http.Cookie{
-		Name:   "JSESSIONID",
-		Value:  s.token,
-		MaxAge: 300,
-	})
+	req.AddCookie(s.authCookie())
 
 	// Make request
-	res, err := s.c.Do(req)
+	res, err := s.do(req, endpointMessageReply)
 	if err != nil {
-		return false, fmt.Errorf("%w: %s", ErrRequestFailed, err)
+		return false, &RequestError{Kind: ErrRequestFailed, URL: u, Err: err}
 	}
 	defer res.Body.Close()
 
-	// Check status code to determine result
-	switch res.StatusCode {
-	case http.StatusOK:
-		return true, nil
-	case http.StatusForbidden:
-		return false, ErrBlockedByServer
-	default:
-		return false, nil
-	}
+	return s.sent(res, u)
 }
 
 // Forward asks 10MinuteMail to forward the message with the
@@ -496,56 +2243,278 @@ func (s *Session) Reply(messageid, body string) (bool, error) {
 //
 // Returns a bool indicating whether or not the forward request was
 // issued successfully and an error if issues were encountered while
-// making the request.
+// making the request. As with Reply, WithStrictMode reports failures
+// as errors, including ErrExpiredMessage.
 //
 // Note that the server will claim to be successful even if the recipient
 // address is invalid or the mail gets rejected after sending.
+//
+// Since the server can't be trusted to reject them, recipients that
+// aren't valid addresses fail with ErrInvalidRecipient, and forwarding
+// to the session's own address fails with ErrForwardToSelf, both
+// without making a request.
+//
+// ErrSessionExpired is returned without making a request if the
+// session has expired, unless disabled with WithExpiryGuard. Forwards
+// are spaced out as configured by WithSendRate.
 func (s *Session) Forward(messageid, recipient string) (bool, error) {
+	return s.ForwardContext(context.Background(), messageid, recipient)
+}
+
+// ForwardContext is like Forward, but gives up waiting to send, or on
+// the request itself, once ctx is done.
+func (s *Session) ForwardContext(ctx context.Context, messageid, recipient string) (bool, error) {
+	if err := s.checkExpired(); err != nil {
+		return false, err
+	}
+
+	to, err := s.recipient(recipient)
+	if err != nil {
+		return false, err
+	}
+	if err := s.waitSend(ctx); err != nil {
+		return false, err
+	}
+
 	// Prepare body
 	reqbody := &internal.ForwardRequest{}
 	reqbody.Forward.MessageID = messageid
-	reqbody.Forward.ForwardAddress = recipient
+	reqbody.Forward.ForwardAddress = to.Address
 
 	reqbytes, err := json.Marshal(reqbody)
 	if err != nil {
-		return false, fmt.Errorf("%w: %s", ErrMarshalFailed, err)
+		return false, &RequestError{Kind: ErrMarshalFailed, Err: err}
 	}
 
 	// Prepare request
 	u := join(s.baseurl, endpointMessageForward)
-	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(reqbytes))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(reqbytes))
 	if err != nil {
-		return false, fmt.Errorf("%w: %s", ErrBuildingRequest, err)
+		return false, &RequestError{Kind: ErrBuildingRequest, URL: u, Err: err}
 	}
 
-	req.Header = s.headers()
+	req.Header = s.headers(req.Method)
 
 	// Set headers
 	req.Header.Add("Content-Type", "application/json")
 
 	// Attach token
-	req.AddCookie(&http.Cookie{
-		Name:   "JSESSIONID",
-		Value:  s.token,
-		MaxAge: 300,
-	})
+	req.AddCookie(s.authCookie())
 
 	// Make request
-	res, err := s.c.Do(req)
+	res, err := s.do(req, endpointMessageForward)
 	if err != nil {
-		return false, fmt.Errorf("%w: %s", ErrRequestFailed, err)
+		return false, &RequestError{Kind: ErrRequestFailed, URL: u, Err: err}
 	}
 	defer res.Body.Close()
 
-	// Check status code to determine result
-	switch res.StatusCode {
-	case http.StatusOK:
+	return s.sent(res, u)
+}
+
+// recipient parses the address to forward messages to, rejecting
+// invalid addresses and the session's own.
+func (s *Session) recipient(addr string) (*mail.Address, error) {
+	to, err := mail.ParseAddress(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %w", ErrInvalidRecipient, addr, err)
+	}
+	if strings.EqualFold(to.Address, s.Address()) {
+		return nil, ErrForwardToSelf
+	}
+
+	return to, nil
+}
+
+// ForwardLatest forwards each message received since the last call to
+// Latest or Messages to recipient, returning the number forwarded
+// successfully. Failed forwards, including any the server refuses,
+// don't stop the rest, and are returned together as a *BatchError
+// keyed by message ID.
+//
+// The recipient is checked as by Forward before fetching, so an
+// invalid one doesn't use up the new messages.
+func (s *Session) ForwardLatest(recipient string) (int, error) {
+	if _, err := s.recipient(recipient); err != nil {
+		return 0, err
+	}
+
+	msgs, err := s.Latest()
+	if err != nil {
+		return 0, err
+	}
+
+	return s.forwardAll(msgs, recipient)
+}
+
+// TransferTo forwards every message in the session's inbox to the
+// address of other, such as to merge an inbox about to expire into
+// another. Failed forwards, including any the server refuses, don't
+// stop the rest, and are returned together as a *BatchError keyed by
+// message ID.
+func (s *Session) TransferTo(other *Session) error {
+	if other == nil {
+		return ErrNilSession
+	}
+
+	to := other.Address()
+	if _, err := s.recipient(to); err != nil {
+		return err
+	}
+
+	msgs, err := s.Messages()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.forwardAll(msgs, to)
+	return err
+}
+
+// forwardAll forwards msgs to recipient, returning the number forwarded
+// and a *BatchError for those which failed or were refused, if any.
+func (s *Session) forwardAll(msgs []Message, recipient string) (int, error) {
+	var (
+		n        int
+		failures []BatchFailure
+	)
+	for i, m := range msgs {
+		ok, err := s.Forward(m.ID, recipient)
+		if err == nil && !ok {
+			err = fmt.Errorf("%w: forward refused", ErrRequestFailed)
+		}
+		if err != nil {
+			failures = append(failures, BatchFailure{Index: i, Key: m.ID, Err: err})
+			continue
+		}
+		n++
+	}
+
+	if len(failures) > 0 {
+		return n, &BatchError{Failures: failures}
+	}
+
+	return n, nil
+}
+
+// sent interprets the response to a reply or forward request to u.
+// The server refuses messages which are too old with a client error,
+// which is only reported as ErrExpiredMessage in strict mode, along
+// with any other failure.
+func (s *Session) sent(res *http.Response, u string) (bool, error) {
+	switch {
+	case res.StatusCode == http.StatusOK:
 		return true, nil
-	case http.StatusForbidden:
-		return false, ErrBlockedByServer
-	default:
+	case res.StatusCode == http.StatusForbidden:
+		return false, &StatusError{Kind: ErrBlockedByServer, URL: u, StatusCode: res.StatusCode}
+	case !s.cfg.strict:
 		return false, nil
+	case res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests:
+		return false, &StatusError{Kind: ErrExpiredMessage, URL: u, StatusCode: res.StatusCode}
+	default:
+		return false, &StatusError{Kind: ErrRequestFailed, URL: u, StatusCode: res.StatusCode}
+	}
+}
+
+// normaliseAddress strips any display name from an email address
+// and lower cases it.
+func normaliseAddress(addr string) string {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		addr = a.Address
+	}
+
+	return strings.ToLower(strings.TrimSpace(addr))
+}
+
+// getJSON makes an authenticated GET request to the endpoint made up
+// of the provided URL components and unmarshals the response into v.
+func (s *Session) getJSON(v interface{}, endpoint ...string) error {
+	// Prepare request
+	u := join(s.baseurl, endpoint...)
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return &RequestError{Kind: ErrBuildingRequest, URL: u, Err: err}
+	}
+
+	req.Header = s.headers(req.Method)
+
+	// Attach token
+	req.AddCookie(s.authCookie())
+
+	// Make request
+	res, err := s.do(req, endpoint[0])
+	if err != nil {
+		return &RequestError{Kind: ErrRequestFailed, URL: u, Err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusForbidden {
+		return &StatusError{Kind: ErrBlockedByServer, URL: u, StatusCode: res.StatusCode}
+	}
+
+	// Read body
+	b, err := s.readBody(res)
+	if err != nil {
+		return err
+	}
+
+	// Unmarshal response
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return &RequestError{Kind: ErrUnmarshalFailed, URL: u, Err: err}
+	}
+
+	return nil
+}
+
+// readBody reads the body of res, failing with ErrBodyTooLarge
+// rather than reading more than the configured limit.
+func (s *Session) readBody(res *http.Response) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(res.Body, s.cfg.maxBodySize+1))
+	if err != nil {
+		var u string
+		if res.Request != nil {
+			u = res.Request.URL.String()
+		}
+		return nil, &RequestError{Kind: ErrReadBody, URL: u, Err: err}
+	}
+	s.stats.addBytes(len(b))
+	if int64(len(b)) > s.cfg.maxBodySize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrBodyTooLarge, s.cfg.maxBodySize)
+	}
+
+	return b, nil
+}
+
+// transient reports whether err is likely to go away if the
+// request is retried.
+func transient(err error) bool {
+	return errors.Is(err, ErrRequestFailed) ||
+		errors.Is(err, ErrReadBody) ||
+		errors.Is(err, ErrBlockedByServer)
+}
+
+// FollowLink makes a GET request to rawurl, such as a confirmation
+// link from a received message, using the session's HTTP client so the
+// same TLS fingerprint and proxy are used. Redirects are followed.
+//
+// The session token is not sent. The caller must close the body of
+// the returned response.
+func (s *Session) FollowLink(rawurl string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, &RequestError{Kind: ErrBuildingRequest, URL: rawurl, Err: err}
+	}
+
+	req.Header = s.headers(req.Method)
+	// Don't tell other sites where the link came from
+	req.Header.Del("Referer")
+
+	res, err := s.do(req, "link")
+	if err != nil {
+		return nil, &RequestError{Kind: ErrRequestFailed, URL: rawurl, Err: err}
 	}
+
+	return res, nil
 }
 
 // join concatinates URL components.
@@ -1,8 +1,24 @@
 package tmm
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -90,3 +106,1684 @@ func TestJoin(t *testing.T) {
 		})
 	}
 }
+
+func TestNewWithEnv(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "tmm-test" {
+			t.Errorf("unexpected user agent %q", r.Header.Get("User-Agent"))
+		}
+
+		c, err := r.Cookie("JSESSIONID")
+		if err != nil || c.Value != "abc123" {
+			t.Errorf("session token was not sent")
+		}
+
+		w.Write([]byte(`{"address":"test@example.com"}`))
+	}))
+	defer srv.Close()
+
+	t.Setenv("TMM_USER_AGENT", "tmm-test")
+	t.Setenv("TMM_TIMEOUT", "5s")
+	t.Setenv("TMM_BASE_URL", srv.URL)
+	t.Setenv("TMM_SESSION_TOKEN", "abc123")
+
+	s, err := NewWithEnv()
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+
+	if s.Address() != "test@example.com" {
+		t.Errorf("Got %s, want test@example.com", s.Address())
+	}
+}
+
+func TestNewWithEnvInvalid(t *testing.T) {
+	t.Setenv("TMM_TIMEOUT", "soon")
+
+	_, err := NewWithEnv()
+	if !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Got %v, want ErrInvalidOption", err)
+	}
+}
+
+// newTestSession creates a session against a local server which hands
+// out a session on the address endpoint and passes everything else to h.
+func newTestSession(t *testing.T, h http.HandlerFunc, opts ...Option) *Session {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+endpointAddress {
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+			w.Write([]byte(`{"address":"test@example.com"}`))
+			return
+		}
+		h(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	s, err := New(append([]Option{WithBaseURL(srv.URL)}, opts...)...)
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+
+	return s
+}
+
+func TestReceive(t *testing.T) {
+	polls := 0
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls < 2 {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00","subject":"Your code","bodyPlainText":"Your code is 123456."}]`))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	code, err := s.Receive(ctx, regexp.MustCompile(`code is (\d{6})`), time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error receiving code: %s", err)
+	}
+
+	if code != "123456" {
+		t.Errorf("Got %s, want 123456", code)
+	}
+}
+
+func TestReceiveDefaultInterval(t *testing.T) {
+	defer func(d time.Duration) { nextInterval = d }(nextInterval)
+	nextInterval = time.Millisecond
+
+	polls := 0
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls < 2 {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00","bodyPlainText":"Your code is 123456."}]`))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	code, err := s.Receive(ctx, regexp.MustCompile(`code is (\d{6})`), 0)
+	if err != nil || code != "123456" {
+		t.Errorf("Got %q and %v with no interval, want 123456", code, err)
+	}
+
+	s.lastreset = time.Now().Add(-10 * time.Minute)
+	if _, err := s.Receive(ctx, regexp.MustCompile(`code`), 0); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("Got %v for an expired session, want ErrSessionExpired", err)
+	}
+}
+
+func TestTryLatest(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+			<-unblock
+		default:
+		}
+		w.Write([]byte(`[]`))
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := s.Latest(); err != nil {
+			t.Errorf("unexpected error fetching latest messages: %s", err)
+		}
+	}()
+	<-started
+
+	_, ok, err := s.TryLatest()
+	if ok || err != nil {
+		t.Errorf("TryLatest ran while Latest was in flight: ok=%v err=%v", ok, err)
+	}
+
+	close(unblock)
+	<-done
+
+	_, ok, err = s.TryLatest()
+	if !ok || err != nil {
+		t.Errorf("TryLatest didn't run on an idle session: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestNewMissingSession(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"address":""}`))
+	}))
+	defer srv.Close()
+
+	_, err := New(WithBaseURL(srv.URL))
+	if !errors.Is(err, ErrMissingSession) {
+		t.Fatalf("Got %v, want ErrMissingSession", err)
+	}
+
+	want := "missing session cookie in response: status 503, no cookies"
+	if err.Error() != want {
+		t.Errorf("Got %q, want %q", err, want)
+	}
+}
+
+func TestSenders(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00","sender":"Service <noreply@example.com>"},
+			{"id":"2","sentDate":"2021-11-28T08:22:06.000+00:00","sender":"other@example.org"},
+			{"id":"3","sentDate":"2021-11-28T08:23:06.000+00:00","sender":"NoReply@Example.com"}
+		]`))
+	})
+
+	senders, err := s.Senders()
+	if err != nil {
+		t.Fatalf("unexpected error listing senders: %s", err)
+	}
+
+	want := []string{"noreply@example.com", "other@example.org"}
+	if strings.Join(senders, ",") != strings.Join(want, ",") {
+		t.Errorf("Got %v, want %v", senders, want)
+	}
+
+	if s.lastcount != 0 {
+		t.Errorf("Senders moved the message counter to %d", s.lastcount)
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	want := time.Date(2021, 11, 28, 8, 21, 6, 0, time.UTC)
+
+	tests := []string{
+		"2021-11-28T08:21:06.000+00:00",
+		"2021-11-28T08:21:06.000+0000",
+		"2021-11-28T08:21:06+0000",
+		"2021-11-28T08:21:06Z",
+		"2021-11-28T09:21:06+01:00",
+	}
+
+	for _, v := range tests {
+		got, err := parseDate(v)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", v, err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%s: Got %s, want %s", v, got, want)
+		}
+	}
+
+	if _, err := parseDate("28/11/2021"); err == nil {
+		t.Error("expected error for unknown layout")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	blocked := false
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if blocked {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}, WithLogger(l))
+
+	if _, err := s.Latest(); err != nil {
+		t.Fatalf("unexpected error fetching messages: %s", err)
+	}
+	if !strings.Contains(buf.String(), "level=DEBUG msg=\"request completed\" method=GET endpoint=messages/messagesAfter") {
+		t.Errorf("request not logged at debug level:\n%s", buf.String())
+	}
+
+	blocked = true
+	if _, err := s.Latest(); !errors.Is(err, ErrBlockedByServer) {
+		t.Fatalf("Got %v, want ErrBlockedByServer", err)
+	}
+	if !strings.Contains(buf.String(), "level=WARN msg=\"request blocked by server\"") {
+		t.Errorf("block not logged at warn level:\n%s", buf.String())
+	}
+}
+
+func TestPing(t *testing.T) {
+	left := "300"
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+endpointSecondsLeft {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"secondsLeft":` + left + `}`))
+	})
+
+	if err := s.Ping(); err != nil {
+		t.Errorf("unexpected error pinging live session: %s", err)
+	}
+
+	left = "0"
+	if err := s.Ping(); !errors.Is(err, ErrMissingSession) {
+		t.Errorf("Got %v, want ErrMissingSession", err)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	var polls int32
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&polls, 1) < 3 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"secondsLeft":300}`))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.WaitReady(ctx); err != nil {
+		t.Errorf("unexpected error waiting for session: %s", err)
+	}
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := s.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestExpiryGuard(t *testing.T) {
+	requests := 0
+	h := func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}
+
+	s := newTestSession(t, h)
+	s.lastreset = time.Now().Add(-time.Hour)
+
+	ok, err := s.Forward("1", "someone@example.com")
+	if ok || !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("Got %v, %v, want ErrSessionExpired", ok, err)
+	}
+	if requests != 0 {
+		t.Errorf("request made despite expired session")
+	}
+
+	s = newTestSession(t, h, WithExpiryGuard(false))
+	s.lastreset = time.Now().Add(-time.Hour)
+
+	ok, err = s.Reply("1", "hello")
+	if !ok || err != nil {
+		t.Errorf("Got %v, %v, want successful reply", ok, err)
+	}
+	if requests != 1 {
+		t.Errorf("request not made with guard disabled")
+	}
+}
+
+func TestLastMessagesSnapshot(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(ExampleMessages))
+	})
+
+	if snap := s.LastMessagesSnapshot(); snap != nil {
+		t.Errorf("Got %v before any fetch, want nil", snap)
+	}
+
+	if _, err := s.Messages(); err != nil {
+		t.Fatalf("unexpected error fetching messages: %s", err)
+	}
+
+	snap := s.LastMessagesSnapshot()
+	if len(snap) != 1 || snap[0].Subject != "Testing" {
+		t.Fatalf("Got %v, want the fetched message", snap)
+	}
+
+	snap[0].Subject = "changed"
+	if s.LastMessagesSnapshot()[0].Subject != "Testing" {
+		t.Error("modifying the snapshot changed the session state")
+	}
+}
+
+// roundTripFunc adapts a function to http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestErrorChain(t *testing.T) {
+	c := &http.Client{
+		Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+			return nil, context.DeadlineExceeded
+		}),
+	}
+
+	_, err := NewWithClient(c)
+	if !errors.Is(err, ErrRequestFailed) {
+		t.Errorf("Got %v, want ErrRequestFailed", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestLatestConcurrent(t *testing.T) {
+	const total = 10
+
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		after, _ := strconv.Atoi(path.Base(r.URL.Path))
+
+		var mail []string
+		for i := after; i < total; i++ {
+			mail = append(mail, fmt.Sprintf(`{"id":"%d","sentDate":"2021-11-28T08:21:06.000+00:00"}`, i))
+		}
+		w.Write([]byte("[" + strings.Join(mail, ",") + "]"))
+	})
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mail, err := s.Latest()
+			if err != nil {
+				t.Errorf("unexpected error fetching messages: %s", err)
+				return
+			}
+
+			mu.Lock()
+			for _, m := range mail {
+				seen[m.ID]++
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != total {
+		t.Errorf("Got %d distinct messages, want %d", len(seen), total)
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("message %s returned %d times", id, n)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	src := &Session{
+		address:   "src@example.com",
+		token:     "src-token",
+		lastreset: time.Now().Add(-10*time.Minute + 50*time.Millisecond),
+		lastcount: 3,
+	}
+
+	c := &http.Client{}
+	dst := &Session{
+		address:   "dst@example.com",
+		c:         c,
+		lastreset: time.Now(),
+		cookies:   []*http.Cookie{{Name: "JSESSIONID", Value: "dst-token"}},
+		last:      []Message{{ID: "old"}},
+		pending:   []Message{{ID: "old"}},
+	}
+	done := dst.Done()
+
+	if err := dst.Copy(src); err != nil {
+		t.Fatalf("unexpected error copying session: %s", err)
+	}
+
+	if dst.address != src.address || dst.token != src.token || dst.lastcount != 3 || !dst.lastreset.Equal(src.lastreset) {
+		t.Errorf("state not copied: %+v", dst)
+	}
+	if dst.c != c {
+		t.Errorf("client was replaced")
+	}
+	if dst.cookies != nil || dst.last != nil || dst.pending != nil {
+		t.Errorf("Got cookies %v, messages %v and pending %v, want those of the old mailbox dropped", dst.cookies, dst.last, dst.pending)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Done wasn't closed at the copied expiry")
+	}
+
+	if err := dst.Copy(nil); err != ErrNilSession {
+		t.Errorf("Got %v, want ErrNilSession", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}, WithRateLimit(1, 1), WithTimeout(50*time.Millisecond))
+
+	// The session was created with the only token in the bucket,
+	// so the next request would have to wait a second.
+	_, err := s.Latest()
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Got %v, want ErrRateLimited", err)
+	}
+}
+
+func TestExportCookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+		http.SetCookie(w, &http.Cookie{Name: "__cf_bm", Value: "challenge", Path: "/"})
+		w.Write([]byte(`{"address":"test@example.com"}`))
+	}))
+	defer srv.Close()
+
+	s, err := New(WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+
+	cookies := s.ExportCookies()
+	if len(cookies) != 2 {
+		t.Fatalf("Got %d cookies, want 2", len(cookies))
+	}
+	if cookies[0].Name != "JSESSIONID" || cookies[0].Value != "token" || cookies[0].Domain != "127.0.0.1" {
+		t.Errorf("unexpected session cookie %+v", cookies[0])
+	}
+
+	cookies[1].Value = "changed"
+	if s.ExportCookies()[1].Value != "challenge" {
+		t.Error("modifying an exported cookie changed the session state")
+	}
+}
+
+func TestExpiryGuardFetch(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+	})
+	s.lastreset = time.Now().Add(-time.Hour)
+
+	if _, err := s.Latest(); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("Latest: Got %v, want ErrSessionExpired", err)
+	}
+	if _, err := s.Renew(); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("Renew: Got %v, want ErrSessionExpired", err)
+	}
+}
+
+func TestFollowLink(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+	}, WithUserAgent("tmm-test"))
+
+	link := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "tmm-test" {
+			t.Errorf("session user agent not used")
+		}
+		if _, err := r.Cookie("JSESSIONID"); err == nil {
+			t.Errorf("session token sent to third party")
+		}
+		w.Write([]byte("confirmed"))
+	}))
+	defer link.Close()
+
+	res, err := s.FollowLink(link.URL + "/confirm")
+	if err != nil {
+		t.Fatalf("unexpected error following link: %s", err)
+	}
+	defer res.Body.Close()
+
+	b, _ := io.ReadAll(res.Body)
+	if string(b) != "confirmed" {
+		t.Errorf("Got %q, want confirmed", b)
+	}
+}
+
+func TestDone(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Response":"reset"}`))
+	}, WithExpiryGuard(false))
+
+	select {
+	case <-s.Done():
+		t.Fatal("fresh session reported as done")
+	default:
+	}
+
+	// Make the session look like it's about to expire
+	s.lastreset = time.Now().Add(-10*time.Minute + 20*time.Millisecond)
+	s.armExpiry()
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("done channel not closed on expiry")
+	}
+
+	if ok, err := s.Renew(); !ok || err != nil {
+		t.Fatalf("Got %v, %v, want successful renewal", ok, err)
+	}
+
+	select {
+	case <-s.Done():
+		t.Error("renewed session reported as done")
+	default:
+	}
+}
+
+func TestDedup(t *testing.T) {
+	// A server whose counter has got out of sync with ours, returning
+	// the second message again on the next poll.
+	polls := []string{
+		`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"},{"id":"2","sentDate":"2021-11-28T08:22:06.000+00:00"}]`,
+		`[{"id":"2","sentDate":"2021-11-28T08:22:06.000+00:00"},{"id":"3","sentDate":"2021-11-28T08:23:06.000+00:00"}]`,
+	}
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(polls[0]))
+		polls = polls[1:]
+	}, WithDedup())
+
+	first, err := s.Latest()
+	if err != nil || len(first) != 2 {
+		t.Fatalf("Got %v, %v, want two messages", first, err)
+	}
+
+	second, err := s.Latest()
+	if err != nil {
+		t.Fatalf("unexpected error fetching messages: %s", err)
+	}
+	if len(second) != 1 || second[0].ID != "3" {
+		t.Errorf("Got %v, want only message 3", second)
+	}
+}
+
+func TestSeenSet(t *testing.T) {
+	s := newSeenSet(2)
+
+	if !s.add("a") || !s.add("b") {
+		t.Fatal("new ids reported as seen")
+	}
+	if s.add("a") {
+		t.Error("seen id reported as new")
+	}
+
+	// Pushes out a
+	s.add("c")
+	if !s.add("a") {
+		t.Error("oldest id wasn't forgotten")
+	}
+}
+
+func TestOnExpiry(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Response":"reset"}`))
+	})
+
+	fired := make(chan string, 2)
+	s.OnExpiry(func() { fired <- "a" })
+	s.OnExpiry(func() { fired <- "b" })
+
+	// Renewing pushes the expiry back, so nothing should fire yet
+	s.lastreset = time.Now().Add(-10*time.Minute + 20*time.Millisecond)
+	s.armExpiry()
+	if ok, err := s.Renew(); !ok || err != nil {
+		t.Fatalf("Got %v, %v, want successful renewal", ok, err)
+	}
+
+	select {
+	case name := <-fired:
+		t.Fatalf("callback %s fired after renewal", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.lastreset = time.Now().Add(-10 * time.Minute)
+	s.armExpiry()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-fired:
+		case <-time.After(time.Second):
+			t.Fatal("callbacks not fired on expiry")
+		}
+	}
+}
+
+func TestRenewAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"address kept", `{"Response":"reset"}`, "test@example.com"},
+		{"address replaced", `{"Response":"reset","address":"new@example.com"}`, "new@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changed []string
+			s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}, WithAddressChangeHook(func(old, new string) {
+				changed = append(changed, old, new)
+			}))
+
+			if ok, err := s.Renew(); !ok || err != nil {
+				t.Fatalf("Got %v, %v, want successful renewal", ok, err)
+			}
+			if s.Address() != tt.want {
+				t.Errorf("Got %s, want %s", s.Address(), tt.want)
+			}
+
+			if tt.want == "test@example.com" {
+				if changed != nil {
+					t.Errorf("hook called with %q for unchanged address", changed)
+				}
+			} else if len(changed) != 2 || changed[0] != "test@example.com" || changed[1] != tt.want {
+				t.Errorf("Got hook calls %q, want change to %s", changed, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessagesLimit(t *testing.T) {
+	var after string
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, endpointMessageCount) {
+			w.Write([]byte(`{"messageCount":5}`))
+			return
+		}
+		after = path.Base(r.URL.Path)
+		w.Write([]byte(`[{"id":"4","sentDate":"2021-11-28T08:24:06.000+00:00"},{"id":"5","sentDate":"2021-11-28T08:25:06.000+00:00"},{"id":"6","sentDate":"2021-11-28T08:26:06.000+00:00"}]`))
+	})
+
+	m, err := s.MessagesLimit(2)
+	if err != nil {
+		t.Fatalf("unexpected error fetching messages: %s", err)
+	}
+
+	if after != "3" {
+		t.Errorf("Got messages after %s, want after 3", after)
+	}
+	if len(m) != 2 || m[0].ID != "6" || m[1].ID != "5" {
+		t.Errorf("Got %v, want messages 6 and 5", m)
+	}
+	if s.lastcount != 6 {
+		t.Errorf("Got counter %d, want 6", s.lastcount)
+	}
+}
+
+func TestMailboxGone(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"with message", `{"status":404,"error":"Not Found","message":"No session"}`, "No session"},
+		{"error only", ` {"error":"Not Found"}`, "Not Found"},
+		{"empty", `{}`, ErrMailboxGone.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			})
+
+			_, err := s.messages(0)
+			if !errors.Is(err, ErrMailboxGone) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Got %v, want ErrMailboxGone mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewWithDomain(t *testing.T) {
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+		if atomic.AddInt32(&n, 1) < 3 {
+			w.Write([]byte(`{"address":"test@blocked.example.com"}`))
+			return
+		}
+		w.Write([]byte(`{"address":"test@example.com"}`))
+	}))
+	defer srv.Close()
+
+	s, err := NewWithDomain("EXAMPLE.com", WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+	if s.Address() != "test@example.com" || n != 3 {
+		t.Errorf("Got %s after %d attempts, want test@example.com after 3", s.Address(), n)
+	}
+
+	if _, err := NewWithDomain("other.example.com", WithBaseURL(srv.URL)); !errors.Is(err, ErrDomainUnavailable) {
+		t.Errorf("Got %v, want ErrDomainUnavailable", err)
+	}
+}
+
+func TestRenewIfNeeded(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration
+		left    int64
+		want    bool
+		resets  int32
+		queries int32
+	}{
+		{"not close", time.Minute, 540, false, 0, 0},
+		{"server has longer", 9*time.Minute + 30*time.Second, 300, false, 0, 1},
+		{"close", 9*time.Minute + 30*time.Second, 30, true, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resets, queries int32
+			s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, endpointSecondsLeft) {
+					atomic.AddInt32(&queries, 1)
+					fmt.Fprintf(w, `{"secondsLeft":%d}`, tt.left)
+					return
+				}
+				atomic.AddInt32(&resets, 1)
+				w.Write([]byte(`{"Response":"reset"}`))
+			})
+			s.lastreset = time.Now().Add(-tt.age)
+
+			ok, err := s.RenewIfNeeded(time.Minute)
+			if err != nil || ok != tt.want {
+				t.Errorf("Got %v, %v, want %v", ok, err, tt.want)
+			}
+			if resets != tt.resets || queries != tt.queries {
+				t.Errorf("Got %d resets and %d queries, want %d and %d", resets, queries, tt.resets, tt.queries)
+			}
+		})
+	}
+}
+
+func TestRenewLoop(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, nil))
+
+	var resets int32
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&resets, 1)
+		w.Write([]byte(`{"Response":"reset"}`))
+	}, WithLogger(l))
+
+	// Renew every 20ms or so
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := s.RenewLoop(ctx, 10*time.Minute-20*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got %v, want context.DeadlineExceeded", err)
+	}
+	if n := atomic.LoadInt32(&resets); n < 2 {
+		t.Errorf("Got %d renewals, want at least 2", n)
+	}
+	if !strings.Contains(buf.String(), "level=INFO msg=\"renewing session\" address=test@example.com renewed=true") {
+		t.Errorf("renewal not logged:\n%s", buf.String())
+	}
+
+	for _, d := range []time.Duration{0, -time.Second, 10 * time.Minute, time.Hour} {
+		if err := s.RenewLoop(ctx, d); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("Got %v for a renewal window of %s, want ErrInvalidOption", err, d)
+		}
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[` + strings.Repeat(" ", 100) + `]`))
+	}, WithMaxBodySize(50))
+
+	if _, err := s.Messages(); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("Got %v, want ErrBodyTooLarge", err)
+	}
+}
+
+func TestRawAddressResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+		w.Write([]byte(`{"address":"test@example.com","domain":"example.com"}`))
+	}))
+	defer srv.Close()
+
+	s, err := New(WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+
+	v := s.RawAddressResponse()
+	if v == nil || v.Address != "test@example.com" {
+		t.Fatalf("Got %+v, want address test@example.com", v)
+	}
+	if string(v.Fields["domain"]) != `"example.com"` {
+		t.Errorf("Got domain %s, want \"example.com\"", v.Fields["domain"])
+	}
+
+	if (&Session{}).RawAddressResponse() != nil {
+		t.Error("Got a response for a session that wasn't created")
+	}
+}
+
+func TestCheckConnectivity(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+endpointAddress {
+			t.Error("address requested")
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	if err := CheckConnectivity(WithBaseURL(srv.URL)); err != nil {
+		t.Errorf("unexpected error checking connectivity: %s", err)
+	}
+
+	status = http.StatusForbidden
+	if err := CheckConnectivity(WithBaseURL(srv.URL)); !errors.Is(err, ErrBlockedByServer) {
+		t.Errorf("Got %v, want ErrBlockedByServer", err)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	now := time.Now()
+	a := &Session{address: "a@example.com", token: "t", lastreset: now, lastcount: 2}
+	b := &Session{address: "a@example.com", token: "t", lastreset: now, lastcount: 2}
+
+	if !a.Equal(b) || !a.SameMailbox(b) {
+		t.Error("identical sessions not equal")
+	}
+
+	b.lastcount = 3
+	if a.Equal(b) || !a.SameMailbox(b) {
+		t.Error("sessions with different counters should only share a mailbox")
+	}
+
+	b.address = "b@example.com"
+	if a.SameMailbox(b) {
+		t.Error("sessions with different addresses share a mailbox")
+	}
+
+	if a.Equal(nil) || a.SameMailbox(nil) {
+		t.Error("session equal to nil")
+	}
+}
+
+func TestWaitForExpiry(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.WaitForExpiry(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got %v, want context.DeadlineExceeded", err)
+	}
+
+	s.lastreset = time.Now().Add(-10*time.Minute + 20*time.Millisecond)
+	s.armExpiry()
+	if err := s.WaitForExpiry(context.Background()); err != nil {
+		t.Errorf("Got %v, want nil on expiry", err)
+	}
+	if !s.Expired() {
+		t.Error("returned before the session expired")
+	}
+}
+
+func TestRefererOrigin(t *testing.T) {
+	headers := make(map[string]http.Header)
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		headers[r.Method] = r.Header.Clone()
+		w.Write([]byte(`[]`))
+	})
+	base := s.baseurl
+
+	s.Messages()
+	s.Reply("1", "hello")
+
+	if got := headers[http.MethodGet].Get("Referer"); got != base+"/" {
+		t.Errorf("Got Referer %q, want %q", got, base+"/")
+	}
+	if got := headers[http.MethodGet].Get("Origin"); got != "" {
+		t.Errorf("Got Origin %q on GET, want none", got)
+	}
+	if got := headers[http.MethodPost].Get("Origin"); got != base {
+		t.Errorf("Got Origin %q on POST, want %q", got, base)
+	}
+
+	s = newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		headers[r.Method] = r.Header.Clone()
+		w.Write([]byte(`[]`))
+	}, WithReferer("https://example.com/inbox"))
+	s.Messages()
+	if got := headers[http.MethodGet].Get("Referer"); got != "https://example.com/inbox" {
+		t.Errorf("Got Referer %q, want the configured one", got)
+	}
+}
+
+func TestLocale(t *testing.T) {
+	var langs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		langs = append(langs, r.Header.Get("Accept-Language"))
+		if r.URL.Path == "/"+endpointAddress {
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+			w.Write([]byte(`{"address":"test@example.com"}`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, DefaultLocale},
+		{[]Option{WithLocale("de-DE,de;q=0.9")}, "de-DE,de;q=0.9"},
+	} {
+		langs = nil
+		s, err := New(append([]Option{WithBaseURL(srv.URL)}, tt.opts...)...)
+		if err != nil {
+			t.Fatalf("unexpected error creating session: %s", err)
+		}
+		s.Messages()
+
+		if len(langs) != 2 || langs[0] != tt.want || langs[1] != tt.want {
+			t.Errorf("Got Accept-Language %q, want %q on every request", langs, tt.want)
+		}
+	}
+
+	if err := Validate(WithLocale("")); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Got %v for an empty locale, want ErrInvalidOption", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, endpointSecondsLeft) {
+			w.Write([]byte(`{"secondsLeft":120}`))
+			return
+		}
+		w.Write([]byte(`{"messageCount":4}`))
+	})
+
+	if err := s.Refresh(); err != nil {
+		t.Fatalf("unexpected error refreshing: %s", err)
+	}
+
+	if left := time.Until(s.ExpiresAt()); left > 2*time.Minute || left < 2*time.Minute-5*time.Second {
+		t.Errorf("Got %s left, want about 2 minutes", left)
+	}
+	if s.lastcount != 4 {
+		t.Errorf("Got counter %d, want 4", s.lastcount)
+	}
+}
+
+func TestInitRetries(t *testing.T) {
+	initRetryDelay = time.Millisecond
+	t.Cleanup(func() { initRetryDelay = 500 * time.Millisecond })
+
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&n, 1) {
+		case 1:
+			// No cookie
+			w.Write([]byte(`{"address":"test@example.com"}`))
+		case 2:
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+			w.Write([]byte(`{"address":""}`))
+		default:
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+			w.Write([]byte(`{"address":"test@example.com"}`))
+		}
+	}))
+	defer srv.Close()
+
+	if _, err := New(WithBaseURL(srv.URL), WithInitRetries(1)); !errors.Is(err, ErrMissingSession) {
+		t.Fatalf("Got %v, want ErrMissingSession after one retry", err)
+	}
+
+	atomic.StoreInt32(&n, 0)
+	s, err := New(WithBaseURL(srv.URL), WithInitRetries(2))
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+	if s.Address() != "test@example.com" || n != 3 {
+		t.Errorf("Got %s after %d attempts, want test@example.com after 3", s.Address(), n)
+	}
+}
+
+func TestMessageReaders(t *testing.T) {
+	m := Message{
+		Plaintext: "Your code is 123456.",
+		HTML:      "<html><style>p { color: red }</style><p>Your code is <b>123456</b>.</p><!-- hidden --></html>",
+	}
+
+	if err := iotest.TestReader(m.PlaintextReader(), []byte(m.Plaintext)); err != nil {
+		t.Errorf("plaintext reader: %s", err)
+	}
+
+	r := m.HTMLReader()
+	if err := iotest.TestReader(r, []byte("Your code is 123456.")); err != nil {
+		t.Errorf("HTML reader: %s", err)
+	}
+
+	r = m.HTMLReader()
+	if err := r.Close(); err != nil {
+		t.Errorf("unexpected error closing HTML reader: %s", err)
+	}
+	if n, err := r.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+		t.Errorf("Got %d, %v reading after Close, want 0, EOF", n, err)
+	}
+}
+
+func TestMarshalMessage(t *testing.T) {
+	var m Message
+	if err := json.Unmarshal([]byte(ExampleMessage), &m); err != nil {
+		t.Fatalf("failed to unmarshal message: %s", err)
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("failed to marshal message: %s", err)
+	}
+	if !strings.Contains(string(b), `"sentDate":"2021-11-28T08:21:06.000+00:00"`) ||
+		!strings.Contains(string(b), `"plaintext":"hello world"`) {
+		t.Errorf("Got %s, want clean names and the server date format", b)
+	}
+
+	var got Message
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("failed to unmarshal marshalled message: %s", err)
+	}
+	if !got.SentDate.Equal(m.SentDate) {
+		t.Errorf("Got sent date %s, want %s", got.SentDate, m.SentDate)
+	}
+	got.SentDate, got.RawSentDate = m.SentDate, m.RawSentDate
+	if got != m {
+		t.Errorf("Got %+v, want %+v", got, m)
+	}
+}
+
+func TestMessageByID(t *testing.T) {
+	var fetches int32
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write([]byte(`[{"id":"1","subject":"a","sentDate":"2021-11-28T08:21:06.000+00:00"},{"id":"2","subject":"b","sentDate":"2021-11-28T08:22:06.000+00:00"}]`))
+	})
+
+	m, err := s.MessageByID("2")
+	if err != nil || m.Subject != "b" {
+		t.Fatalf("Got %v, %v, want message 2", m, err)
+	}
+
+	// Served from the last fetch
+	if m, err := s.MessageByID("1"); err != nil || m.Subject != "a" || fetches != 1 {
+		t.Errorf("Got %v, %v after %d fetches, want message 1 after 1", m, err, fetches)
+	}
+
+	if _, err := s.MessageByID("3"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Got %v, want ErrMessageNotFound", err)
+	}
+}
+
+func TestForwardRecipient(t *testing.T) {
+	var requests int32
+	var sent string
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		b, _ := io.ReadAll(r.Body)
+		sent = string(b)
+	})
+
+	tests := []struct {
+		recipient string
+		want      error
+	}{
+		{"not an address", ErrInvalidRecipient},
+		{"TEST@example.com", ErrForwardToSelf},
+		{"Me <test@example.com>", ErrForwardToSelf},
+	}
+
+	for _, tt := range tests {
+		if _, err := s.Forward("1", tt.recipient); !errors.Is(err, tt.want) {
+			t.Errorf("%q: Got %v, want %v", tt.recipient, err, tt.want)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("Got %d requests for rejected recipients, want none", requests)
+	}
+
+	if ok, err := s.Forward("1", "Someone <someone@example.com>"); !ok || err != nil {
+		t.Fatalf("Got %v, %v, want successful forward", ok, err)
+	}
+	if !strings.Contains(sent, `"someone@example.com"`) {
+		t.Errorf("Got request %s, want the bare address", sent)
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	var tokens []string
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		c, _ := r.Cookie("JSESSIONID")
+		tokens = append(tokens, c.Value)
+		if len(tokens) == 1 {
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "rotated"})
+		}
+		w.Write([]byte(`[]`))
+	})
+
+	s.Messages()
+	s.Messages()
+
+	if len(tokens) != 2 || tokens[0] != "token" || tokens[1] != "rotated" {
+		t.Fatalf("Got tokens %q, want [token rotated]", tokens)
+	}
+	if got := s.sessionToken(); got != "rotated" {
+		t.Errorf("Got session token %q, want rotated", got)
+	}
+}
+
+func TestMaxMessageCount(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"},
+			{"id":"2","sentDate":"2021-11-28T08:25:06.000+00:00"},
+			{"id":"3","sentDate":"2021-11-28T08:23:06.000+00:00"}
+		]`))
+	}, WithMaxMessageCount(2))
+
+	mail, err := s.Messages()
+	if err != nil {
+		t.Fatalf("unexpected error getting messages: %s", err)
+	}
+
+	if len(mail) != 2 || mail[0].ID != "2" || mail[1].ID != "3" {
+		t.Errorf("Got %+v, want messages 2 and 3", mail)
+	}
+
+	if err := Validate(WithMaxMessageCount(0)); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Got error %v for a zero limit, want ErrInvalidOption", err)
+	}
+}
+
+func TestRawSentDate(t *testing.T) {
+	mail, err := ParseMessages([]byte(`[{"id":"1","sentDate":"28/11/2021 08:21"},{"id":"2","sentDate":"2021-11-28T08:21:06.000+00:00"}]`))
+	if err != nil {
+		t.Fatalf("unexpected error parsing messages: %s", err)
+	}
+	if len(mail) != 2 {
+		t.Fatalf("Got %d messages, want 2", len(mail))
+	}
+
+	if !mail[0].SentDate.IsZero() || mail[0].RawSentDate != "28/11/2021 08:21" {
+		t.Errorf("Got %s and %q for a bad date, want zero and the raw string", mail[0].SentDate, mail[0].RawSentDate)
+	}
+	if mail[1].SentDate.IsZero() || mail[1].RawSentDate != "2021-11-28T08:21:06.000+00:00" {
+		t.Errorf("Got %s and %q for a good date, want both set", mail[1].SentDate, mail[1].RawSentDate)
+	}
+
+	b, _ := json.Marshal(mail[0])
+	if !strings.Contains(string(b), `"sentDate":"28/11/2021 08:21"`) {
+		t.Errorf("Got %s, want the raw date written back", b)
+	}
+}
+
+func TestPollRequest(t *testing.T) {
+	var got []string
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		c, _ := r.Cookie("JSESSIONID")
+		got = append(got, r.URL.Path+" "+c.Value+" "+r.Header.Get("User-Agent"))
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token" + strconv.Itoa(len(got))})
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"}]`))
+	})
+
+	s.Latest()
+	s.Latest()
+
+	want := []string{
+		"/" + endpointMessagesAfter + "/0 token " + DefaultUserAgent,
+		"/" + endpointMessagesAfter + "/1 token1 " + DefaultUserAgent,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got requests %q, want %q", got, want)
+	}
+}
+
+// BenchmarkPollRequest compares building the polling request from the
+// session's template with building it from scratch as other requests
+// are. When written, the template took 7 allocations per request
+// against 19 from scratch.
+func BenchmarkPollRequest(b *testing.B) {
+	s := &Session{baseurl: baseURL, token: "token", cfg: defaultConfig()}
+
+	b.Run("template", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.pollRequest(int64(i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("scratch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			req, err := http.NewRequest(http.MethodGet, join(s.baseurl, endpointMessagesAfter, strconv.Itoa(i)), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			req.Header = s.headers(req.Method)
+			req.AddCookie(s.authCookie())
+		}
+	})
+}
+
+// BenchmarkPoll measures the cost of each call to Latest against a
+// local server, including the server's own allocations.
+func BenchmarkPoll(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	s := &Session{baseurl: srv.URL, token: "token", lastreset: time.Now(), c: srv.Client(), cfg: defaultConfig()}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Latest(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestForwardLatest(t *testing.T) {
+	var forwarded []string
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, endpointMessageForward) {
+			b, _ := io.ReadAll(r.Body)
+			if strings.Contains(string(b), `"2"`) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if strings.Contains(string(b), `"3"`) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			forwarded = append(forwarded, string(b))
+			return
+		}
+		w.Write([]byte(`[
+			{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"},
+			{"id":"2","sentDate":"2021-11-28T08:22:06.000+00:00"},
+			{"id":"3","sentDate":"2021-11-28T08:23:06.000+00:00"}
+		]`))
+	})
+
+	if _, err := s.ForwardLatest("not an address"); !errors.Is(err, ErrInvalidRecipient) {
+		t.Fatalf("Got %v, want ErrInvalidRecipient", err)
+	}
+
+	n, err := s.ForwardLatest("someone@example.com")
+	if n != 1 || len(forwarded) != 1 {
+		t.Errorf("Got %d forwarded and %d requests, want 1", n, len(forwarded))
+	}
+
+	var berr *BatchError
+	if !errors.As(err, &berr) || len(berr.Failures) != 2 || !errors.Is(err, ErrBlockedByServer) {
+		t.Fatalf("Got %v, want a BatchError holding the failed forwards", err)
+	}
+	if f := berr.Failures[1]; f.Key != "3" || !errors.Is(f.Err, ErrRequestFailed) {
+		t.Errorf("Got %+v, want the refused forward of message 3 to fail with ErrRequestFailed", f)
+	}
+}
+
+func TestSessionFromToken(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _ := r.Cookie("JSESSIONID")
+		requests = append(requests, r.URL.Path+" "+c.Value)
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	if _, err := SessionFromToken("test@example.com", "", WithBaseURL(srv.URL)); !errors.Is(err, ErrMissingSession) {
+		t.Errorf("Got %v for an empty token, want ErrMissingSession", err)
+	}
+
+	s, err := SessionFromToken("test@example.com", "browser", WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+	if len(requests) != 0 {
+		t.Errorf("Got requests %q creating the session, want none", requests)
+	}
+	if s.Address() != "test@example.com" {
+		t.Errorf("Got address %q, want test@example.com", s.Address())
+	}
+
+	if _, err := s.Messages(); err != nil {
+		t.Fatalf("unexpected error getting messages: %s", err)
+	}
+	if want := "/" + endpointMessagesAfter + "/0 browser"; len(requests) != 1 || requests[0] != want {
+		t.Errorf("Got requests %q, want [%s]", requests, want)
+	}
+}
+
+func TestCookieMaxAge(t *testing.T) {
+	s, err := SessionFromToken("test@example.com", "token", WithCookieMaxAge(900))
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+
+	if got := s.authCookie().MaxAge; got != 900 {
+		t.Errorf("Got request cookie MaxAge %d, want 900", got)
+	}
+	if c := s.ExportCookies(); len(c) != 1 || c[0].MaxAge != 900 {
+		t.Errorf("Got exported cookies %v, want one with MaxAge 900", c)
+	}
+
+	if err := Validate(WithCookieMaxAge(0)); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Got error %v for a zero max age, want ErrInvalidOption", err)
+	}
+}
+
+func TestWithAddress(t *testing.T) {
+	var changes int
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Got unexpected request to %s", r.URL.Path)
+	}, WithAddressChangeHook(func(old, new string) { changes++ }))
+
+	s.WithAddress("fixed@example.com")
+	if s.Address() != "fixed@example.com" {
+		t.Errorf("Got address %q, want fixed@example.com", s.Address())
+	}
+	if changes != 0 {
+		t.Errorf("Got %d address change calls, want none", changes)
+	}
+}
+
+func TestCreatedAt(t *testing.T) {
+	before := time.Now()
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"address":"test@example.com"}`))
+	})
+
+	created := s.CreatedAt()
+	if created.Before(before) || created.After(time.Now()) {
+		t.Errorf("Got created at %s, want between %s and now", created, before)
+	}
+
+	if _, err := s.Renew(); err != nil {
+		t.Fatalf("unexpected error renewing: %s", err)
+	}
+	if !s.CreatedAt().Equal(created) {
+		t.Errorf("Got created at %s after renewing, want %s", s.CreatedAt(), created)
+	}
+}
+
+func TestMessagesAfter(t *testing.T) {
+	var paths []string
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, path.Base(r.URL.Path))
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"},{"id":"2","sentDate":"2021-11-28T08:22:06.000+00:00"}]`))
+	})
+
+	m, cursor, err := s.MessagesAfter(3)
+	if err != nil {
+		t.Fatalf("unexpected error getting messages: %s", err)
+	}
+	if len(m) != 2 || cursor != 5 {
+		t.Errorf("Got %d messages and cursor %d, want 2 and 5", len(m), cursor)
+	}
+
+	// The session's own counter is untouched
+	s.Latest()
+	if want := []string{"3", "0"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Got offsets %q, want %q", paths, want)
+	}
+}
+
+func TestNext(t *testing.T) {
+	defer func(d time.Duration) { nextInterval = d }(nextInterval)
+	nextInterval = time.Millisecond
+
+	var polls int32
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&polls, 1)
+		if path.Base(r.URL.Path) != "0" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[
+			{"id":"2","sentDate":"2021-11-28T08:22:06.000+00:00"},
+			{"id":"3","sentDate":"2021-11-28T08:23:06.000+00:00"},
+			{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"}
+		]`))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		m, err := s.Next(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error getting message %d: %s", i, err)
+		}
+		got = append(got, m.ID)
+	}
+
+	if want := []string{"1", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got messages %q, want %q", got, want)
+	}
+	if n := atomic.LoadInt32(&polls); n != 1 {
+		t.Errorf("Got %d polls, want the buffered messages returned without polling", n)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.Next(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got %v with no new mail, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	var cookies []string
+	src := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		c, _ := r.Cookie("JSESSIONID")
+		cookies = append(cookies, c.Value+" "+path.Base(r.URL.Path))
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"}]`))
+	})
+	src.Latest()
+
+	e := src.Export()
+	if e.Token != "token" || e.Address != "test@example.com" || e.LastCount != 1 || !e.LastReset.Equal(src.lastreset) {
+		t.Errorf("Got %+v, want the state of the session", e)
+	}
+
+	b, _ := json.Marshal(e)
+	var decoded SessionExport
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal export: %s", err)
+	}
+
+	dst, err := SessionFromToken("other@example.com", "other", WithBaseURL(src.baseurl))
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+	dst.pending = []Message{{ID: "old"}}
+	if err := dst.Import(decoded); err != nil {
+		t.Fatalf("unexpected error importing: %s", err)
+	}
+	if !dst.Equal(src) {
+		t.Errorf("Got %+v after import, want %+v", dst.Export(), e)
+	}
+	if dst.pending != nil {
+		t.Errorf("Got pending %v after import, want the old mailbox's dropped", dst.pending)
+	}
+
+	dst.Latest()
+	if want := "token 1"; cookies[len(cookies)-1] != want {
+		t.Errorf("Got request %q after import, want %q", cookies[len(cookies)-1], want)
+	}
+
+	if err := dst.Import(SessionExport{}); !errors.Is(err, ErrMissingSession) {
+		t.Errorf("Got %v importing no token, want ErrMissingSession", err)
+	}
+}
+
+func TestSetToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("JSESSIONID")
+		switch {
+		case err != nil:
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+			w.Write([]byte(`{"address":"test@example.com"}`))
+		case c.Value == "good":
+			w.Write([]byte(`{"address":"other@example.com"}`))
+		default:
+			// An unknown token gets a new session without an address
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "fresh"})
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+
+	// The hook uses the session, so must be called without its locks held
+	var changed []string
+	var s *Session
+	s, err := New(WithBaseURL(srv.URL), WithAddressChangeHook(func(old, new string) {
+		changed = append(changed, old, new)
+		s.Latest()
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+	s.lastcount = 3
+
+	if err := s.SetToken("bad"); !errors.Is(err, ErrMissingSession) {
+		t.Errorf("Got %v for a bad token, want ErrMissingSession", err)
+	}
+	if s.sessionToken() != "token" || s.Address() != "test@example.com" || s.lastcount != 3 {
+		t.Errorf("Got %q and %q after a failed change, want the session unchanged", s.sessionToken(), s.Address())
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.SetToken("good") }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("unexpected error setting token: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SetToken deadlocked calling the address change hook")
+	}
+	if s.sessionToken() != "good" || s.Address() != "other@example.com" || s.lastcount != 0 {
+		t.Errorf("Got %q, %q and counter %d, want the new session", s.sessionToken(), s.Address(), s.lastcount)
+	}
+	if want := []string{"test@example.com", "other@example.com"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("Got address changes %q, want %q", changed, want)
+	}
+
+	if err := s.SetToken(""); !errors.Is(err, ErrMissingSession) {
+		t.Errorf("Got %v for an empty token, want ErrMissingSession", err)
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	status := http.StatusBadRequest
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}
+
+	s := newTestSession(t, handler)
+	if ok, err := s.Reply("1", "hello"); ok || err != nil {
+		t.Errorf("Got %v, %v without strict mode, want false, nil", ok, err)
+	}
+
+	s = newTestSession(t, handler, WithStrictMode())
+	tests := []struct {
+		status int
+		want   error
+	}{
+		{http.StatusBadRequest, ErrExpiredMessage},
+		{http.StatusNotFound, ErrExpiredMessage},
+		{http.StatusInternalServerError, ErrRequestFailed},
+		{http.StatusForbidden, ErrBlockedByServer},
+	}
+
+	for _, tt := range tests {
+		status = tt.status
+		if ok, err := s.Reply("1", "hello"); ok || !errors.Is(err, tt.want) {
+			t.Errorf("Reply %d: Got %v, %v, want %v", tt.status, ok, err, tt.want)
+		}
+		if ok, err := s.Forward("1", "someone@example.com"); ok || !errors.Is(err, tt.want) {
+			t.Errorf("Forward %d: Got %v, %v, want %v", tt.status, ok, err, tt.want)
+		}
+	}
+}
+
+func TestNoContent(t *testing.T) {
+	status := http.StatusNoContent
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+
+	for _, code := range []int{http.StatusNoContent, http.StatusOK} {
+		status = code
+		m, err := s.Messages()
+		if err != nil {
+			t.Errorf("%d: unexpected error getting messages: %s", code, err)
+		}
+		if m == nil || len(m) != 0 {
+			t.Errorf("%d: Got %#v, want an empty slice", code, m)
+		}
+	}
+}
+
+func TestTransferTo(t *testing.T) {
+	var forwards []string
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, endpointMessageForward) {
+			b, _ := io.ReadAll(r.Body)
+			forwards = append(forwards, string(b))
+			if strings.Contains(string(b), `"2"`) {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			return
+		}
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"},{"id":"2","sentDate":"2021-11-28T08:22:06.000+00:00"}]`))
+	})
+
+	other, _ := SessionFromToken("other@example.com", "other")
+
+	if err := s.TransferTo(nil); !errors.Is(err, ErrNilSession) {
+		t.Errorf("Got %v for a nil session, want ErrNilSession", err)
+	}
+	if err := s.TransferTo(s); !errors.Is(err, ErrForwardToSelf) {
+		t.Errorf("Got %v transferring to itself, want ErrForwardToSelf", err)
+	}
+
+	err := s.TransferTo(other)
+	if len(forwards) != 2 || !strings.Contains(forwards[0], `"other@example.com"`) {
+		t.Errorf("Got forwards %q, want both messages sent to other@example.com", forwards)
+	}
+
+	var berr *BatchError
+	if !errors.As(err, &berr) || len(berr.Failures) != 1 || berr.Failures[0].Key != "2" {
+		t.Errorf("Got %v, want a BatchError for message 2", err)
+	}
+}
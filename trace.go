@@ -0,0 +1,134 @@
+package tmm
+
+import (
+	ctls "crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// RequestTrace describes how a request made by a session was sent,
+// as reported to the function passed to WithTrace.
+type RequestTrace struct {
+	// The API endpoint called.
+	Endpoint string
+	// Whether the request was sent on a pooled connection rather
+	// than a newly dialed one.
+	Reused bool
+
+	// How long resolving the host, connecting to it and performing
+	// the TLS handshake took. Zero if they didn't happen, such as
+	// when the connection was reused.
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+
+	// The status code of the response, or zero if the request failed.
+	StatusCode int
+	// The error the request failed with, if any.
+	Err error
+}
+
+// WithTrace calls fn after every request made by the session with
+// details of how it was sent, such as whether it needed a new TLS
+// handshake. This is useful for correlating failures with new
+// connections.
+func WithTrace(fn func(RequestTrace)) Option {
+	return func(c *config) error {
+		c.trace = fn
+		return nil
+	}
+}
+
+// tracer collects the timings of a single request.
+type tracer struct {
+	mu sync.Mutex
+	t  RequestTrace
+
+	dnsStart, connectStart, tlsStart time.Time
+}
+
+// clientTrace returns the hooks which record into t. They may be called
+// from the transport's dialing goroutine, so access is locked.
+func (t *tracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.t.Reused = info.Reused
+			t.mu.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.t.DNS = time.Since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			t.connectStart = time.Now()
+			t.mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			t.t.Connect = time.Since(t.connectStart)
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(ctls.ConnectionState, error) {
+			t.mu.Lock()
+			t.t.TLSHandshake = time.Since(t.tlsStart)
+			t.mu.Unlock()
+		},
+	}
+}
+
+// traceRequest attaches a tracer to req if tracing is enabled,
+// returning the request to send and a function to call with the
+// outcome. The returned function does nothing if tracing is disabled.
+func (s *Session) traceRequest(req *http.Request, endpoint string) (*http.Request, func(*http.Response, error)) {
+	if s.cfg.trace == nil {
+		return req, func(*http.Response, error) {}
+	}
+
+	t := &tracer{t: RequestTrace{Endpoint: endpoint}}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), t.clientTrace()))
+
+	return req, func(res *http.Response, err error) {
+		t.mu.Lock()
+		rt := t.t
+		t.mu.Unlock()
+
+		if res != nil {
+			rt.StatusCode = res.StatusCode
+		}
+		rt.Err = err
+		s.cfg.trace(rt)
+	}
+}
+
+// connectionState converts the state of a uTLS connection to the
+// crypto/tls form expected by httptrace.
+func connectionState(c *tls.UConn) ctls.ConnectionState {
+	st := c.ConnectionState()
+	return ctls.ConnectionState{
+		Version:            st.Version,
+		HandshakeComplete:  st.HandshakeComplete,
+		DidResume:          st.DidResume,
+		CipherSuite:        st.CipherSuite,
+		NegotiatedProtocol: st.NegotiatedProtocol,
+		ServerName:         st.ServerName,
+		PeerCertificates:   st.PeerCertificates,
+		VerifiedChains:     st.VerifiedChains,
+	}
+}
@@ -0,0 +1,428 @@
+package tmm
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	ctls "crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// NewTransport builds the HTTP transport that New would use for the
+// provided options, dialing every TLS connection with the custom
+// ClientHello. Pass it to WithTransport to share one connection pool
+// between many sessions.
+//
+// The returned transport is safe for concurrent use. It doesn't store
+// cookies, so sessions sharing it keep their own separate tokens.
+func NewTransport(opts ...Option) (http.RoundTripper, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTransport(cfg), nil
+}
+
+// newClient builds the HTTP client used by sessions created with New.
+func newClient(cfg config) *http.Client {
+	t := cfg.transport
+	if t == nil {
+		t = newTransport(cfg)
+	}
+
+	return &http.Client{
+		Timeout:   cfg.timeout,
+		Transport: t,
+	}
+}
+
+// newTransport builds the HTTP transport used by sessions created
+// with New, dialing every TLS connection with the custom ClientHello.
+// Its connections share a session ticket cache, so reconnecting to a
+// server can skip the full handshake.
+func newTransport(cfg config) http.RoundTripper {
+	cfg.sessionCache = tls.NewLRUClientSessionCache(sessionCacheSize)
+
+	if cfg.http2 {
+		return newALPNTransport(cfg)
+	}
+
+	return newHTTP1Transport(cfg, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialTLS(ctx, cfg, network, addr)
+	})
+}
+
+// newHTTP1Transport builds an HTTP/1.1 transport which uses dial
+// to open TLS connections.
+func newHTTP1Transport(cfg config, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		DialContext:     newDialer(cfg).DialContext,
+		DialTLSContext:  dial,
+		MaxIdleConns:    cfg.maxIdleConns,
+		IdleConnTimeout: cfg.idleConnTimeout,
+	}
+}
+
+// newDialer returns the dialer used to connect to the server, or
+// to the proxy if one is configured.
+func newDialer(cfg config) *net.Dialer {
+	d := &net.Dialer{Timeout: cfg.dialTimeout}
+	if cfg.localAddr != nil {
+		d.LocalAddr = cfg.localAddr
+	}
+
+	return d
+}
+
+// alpnTransport routes requests over HTTP/2 or HTTP/1.1 depending on
+// which protocol the server picked during the first TLS handshake
+// with each host.
+//
+// The standard library can only upgrade crypto/tls connections to
+// HTTP/2 by itself, so the choice has to be made here instead.
+type alpnTransport struct {
+	cfg config
+	h1  *http.Transport
+	h2  *http2.Transport
+
+	mu sync.Mutex
+	// The protocol negotiated with each host.
+	protos map[string]string
+	// Connections opened while negotiating which haven't
+	// been handed over to h1 or h2 yet.
+	conns map[string]net.Conn
+}
+
+func newALPNTransport(cfg config) *alpnTransport {
+	t := &alpnTransport{
+		cfg:    cfg,
+		protos: make(map[string]string),
+		conns:  make(map[string]net.Conn),
+	}
+	t.h1 = newHTTP1Transport(cfg, t.dial)
+	t.h2 = &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *ctls.Config) (net.Conn, error) {
+			return t.dial(ctx, network, addr)
+		},
+	}
+
+	return t
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *alpnTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return t.h1.RoundTrip(req)
+	}
+
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "443")
+	}
+
+	t.mu.Lock()
+	proto, ok := t.protos[addr]
+	t.mu.Unlock()
+
+	if !ok {
+		conn, err := dialTLS(req.Context(), t.cfg, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		proto = negotiatedProtocol(conn)
+
+		t.mu.Lock()
+		t.protos[addr] = proto
+		if _, ok := t.conns[addr]; ok {
+			// Lost a race with another request; one is enough.
+			conn.Close()
+		} else {
+			t.conns[addr] = conn
+		}
+		t.mu.Unlock()
+	}
+
+	if proto == http2.NextProtoTLS {
+		return t.h2.RoundTrip(req)
+	}
+
+	return t.h1.RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle connections on both transports.
+func (t *alpnTransport) CloseIdleConnections() {
+	t.h1.CloseIdleConnections()
+	t.h2.CloseIdleConnections()
+}
+
+// dial hands over the connection opened while negotiating with addr
+// if there is one, and opens a new one otherwise.
+func (t *alpnTransport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	t.mu.Lock()
+	conn, ok := t.conns[addr]
+	delete(t.conns, addr)
+	t.mu.Unlock()
+
+	if ok {
+		return conn, nil
+	}
+
+	return dialTLS(ctx, t.cfg, network, addr)
+}
+
+// dialTLS opens a connection to addr, through the configured proxy
+// if there is one, and performs the custom TLS handshake on it.
+// Connecting gives up after the configured dial timeout or when ctx
+// is done, whichever comes first, and the handshake gives up after
+// the configured TLS handshake timeout.
+//
+// Handshakes sometimes fail spuriously on flaky networks, so a failed
+// handshake is tried once more on a fresh connection, and then with
+// crypto/tls if WithStandardTLSFallback was given.
+func dialTLS(ctx context.Context, cfg config, network, addr string) (net.Conn, error) {
+	conn, err := dialUTLS(ctx, cfg, network, addr)
+	if !retryHandshake(ctx, err) {
+		return conn, err
+	}
+
+	conn, err = dialUTLS(ctx, cfg, network, addr)
+	if !retryHandshake(ctx, err) || !cfg.standardTLSFallback {
+		return conn, err
+	}
+
+	return dialStandardTLS(ctx, cfg, network, addr)
+}
+
+// handshakeError is returned by the dial functions when the TLS
+// handshake fails, as opposed to connecting or checking the result.
+type handshakeError struct {
+	err error
+}
+
+func (e *handshakeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+// retryHandshake reports whether err is a failed handshake worth
+// trying again.
+func retryHandshake(ctx context.Context, err error) bool {
+	var herr *handshakeError
+	return errors.As(err, &herr) && ctx.Err() == nil
+}
+
+// dialUTLS connects to addr and performs the handshake with the
+// custom ClientHello.
+func dialUTLS(ctx context.Context, cfg config, network, addr string) (net.Conn, error) {
+	conn, host, err := dialConn(ctx, cfg, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		ServerName:         host,
+		RootCAs:            cfg.rootCAs,
+		ClientSessionCache: cfg.sessionCache,
+	}
+	uconn := tls.UClient(conn, config, tls.HelloCustom)
+	if err := uconn.ApplyPreset(newSpec(cfg)); err != nil {
+		conn.Close()
+		return nil, &handshakeError{err}
+	}
+
+	if cfg.tlsHandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(cfg.tlsHandshakeTimeout))
+	}
+
+	// The transport only reports handshakes it performs itself,
+	// so report this one by hand.
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	err = uconn.Handshake()
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(connectionState(uconn), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &handshakeError{err}
+	}
+
+	if cfg.tlsHandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+
+	if err := checkConn(cfg, connectionState(uconn)); err != nil {
+		uconn.Close()
+		return nil, err
+	}
+
+	return uconn, nil
+}
+
+// dialStandardTLS connects to addr and performs the handshake with
+// crypto/tls, giving up the custom ClientHello.
+func dialStandardTLS(ctx context.Context, cfg config, network, addr string) (net.Conn, error) {
+	conn, host, err := dialConn(ctx, cfg, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ctls.Config{
+		ServerName: host,
+		RootCAs:    cfg.rootCAs,
+		NextProtos: []string{"http/1.1"},
+		MinVersion: cfg.tlsMin,
+		MaxVersion: cfg.tlsMax,
+	}
+	if cfg.http2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	if cfg.tlsHandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.tlsHandshakeTimeout)
+		defer cancel()
+	}
+
+	tconn := ctls.Client(conn, config)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, &handshakeError{err}
+	}
+
+	if err := checkConn(cfg, tconn.ConnectionState()); err != nil {
+		tconn.Close()
+		return nil, err
+	}
+
+	return tconn, nil
+}
+
+// dialConn opens a connection to addr, through the configured proxy
+// if there is one, returning it with the host name to verify.
+func dialConn(ctx context.Context, cfg config, network, addr string) (net.Conn, string, error) {
+	d := newDialer(cfg)
+
+	var conn net.Conn
+	var err error
+	if cfg.proxy != nil {
+		conn, err = dialProxy(ctx, d, cfg.proxy, network, addr)
+	} else {
+		conn, err = d.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	return conn, host, nil
+}
+
+// checkConn checks the result of a handshake against the configured
+// minimum TLS version and certificate pins.
+func checkConn(cfg config, st ctls.ConnectionState) error {
+	// The spec can't rule out every version below the minimum
+	if st.Version < cfg.tlsMin {
+		return fmt.Errorf("tls: server negotiated version %#x, below the minimum %#x", st.Version, cfg.tlsMin)
+	}
+
+	if len(cfg.pins) > 0 {
+		return checkPins(cfg.pins, st.PeerCertificates)
+	}
+
+	return nil
+}
+
+// negotiatedProtocol returns the application protocol agreed during
+// the handshake on a connection opened by dialTLS.
+func negotiatedProtocol(conn net.Conn) string {
+	switch c := conn.(type) {
+	case *tls.UConn:
+		return c.ConnectionState().NegotiatedProtocol
+	case *ctls.Conn:
+		return c.ConnectionState().NegotiatedProtocol
+	}
+
+	return ""
+}
+
+// checkPins returns ErrCertPinMismatch unless the public key of one
+// of the certificates in chain matches one of pins.
+func checkPins(pins map[string]bool, chain []*x509.Certificate) error {
+	for _, cert := range chain {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+
+	return ErrCertPinMismatch
+}
+
+// dialProxy connects to the HTTP proxy p using d and asks it
+// to open a tunnel to addr.
+func dialProxy(ctx context.Context, d *net.Dialer, p *url.URL, network, addr string) (net.Conn, error) {
+	paddr := p.Host
+	if p.Port() == "" {
+		paddr = net.JoinHostPort(p.Hostname(), "80")
+	}
+
+	conn, err := d.DialContext(ctx, network, paddr)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if p.User != nil {
+		pass, _ := p.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused tunnel to %s: %s", addr, res.Status)
+	}
+
+	return conn, nil
+}
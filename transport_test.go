@@ -0,0 +1,396 @@
+package tmm
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	ctls "crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestCheckPins(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+
+	chain := []*x509.Certificate{srv.Certificate()}
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+
+	if err := checkPins(map[string]bool{pin: true}, chain); err != nil {
+		t.Errorf("matching pin rejected: %s", err)
+	}
+
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	if err := checkPins(map[string]bool{other: true}, chain); err != ErrCertPinMismatch {
+		t.Errorf("Got %v, want ErrCertPinMismatch", err)
+	}
+}
+
+// withRootCAs trusts the certificate of a local test server.
+func withRootCAs(srv *httptest.Server) Option {
+	return func(c *config) error {
+		c.rootCAs = x509.NewCertPool()
+		c.rootCAs.AddCert(srv.Certificate())
+		return nil
+	}
+}
+
+// newTLSTestServer starts a local TLS server which hands out sessions
+// and returns an empty mailbox, optionally offering HTTP/2.
+func newTLSTestServer(h2 bool, proto *int32) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(proto, int32(r.ProtoMajor))
+		if r.URL.Path == "/"+endpointAddress {
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+			w.Write([]byte(`{"address":"test@example.com"}`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	srv.EnableHTTP2 = h2
+	srv.StartTLS()
+
+	return srv
+}
+
+func TestHTTP2(t *testing.T) {
+	tests := []struct {
+		name   string
+		server bool
+		want   int32
+	}{
+		{"negotiated", true, 2},
+		{"fallback", false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var proto int32
+			srv := newTLSTestServer(tt.server, &proto)
+			defer srv.Close()
+
+			s, err := New(WithBaseURL(srv.URL), withRootCAs(srv), WithHTTP2())
+			if err != nil {
+				t.Fatalf("unexpected error creating session: %s", err)
+			}
+			if _, err := s.Latest(); err != nil {
+				t.Fatalf("unexpected error fetching messages: %s", err)
+			}
+
+			if got := atomic.LoadInt32(&proto); got != tt.want {
+				t.Errorf("Got HTTP/%d, want HTTP/%d", got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkLatest compares concurrent polling throughput over
+// HTTP/1.1 and HTTP/2 against a local server.
+func BenchmarkLatest(b *testing.B) {
+	for _, h2 := range []bool{false, true} {
+		name := "http1"
+		if h2 {
+			name = "http2"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			var proto int32
+			srv := newTLSTestServer(true, &proto)
+			defer srv.Close()
+
+			opts := []Option{WithBaseURL(srv.URL), withRootCAs(srv)}
+			if h2 {
+				opts = append(opts, WithHTTP2())
+			}
+
+			s, err := New(opts...)
+			if err != nil {
+				b.Fatalf("unexpected error creating session: %s", err)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := s.list(0); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestDialTLSContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cfg, _ := newConfig([]Option{WithDialTimeout(time.Second)})
+	_, err := dialTLS(ctx, cfg, "tcp", "127.0.0.1:1")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Got %v, want context.Canceled", err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var proto int32
+	srv := newTLSTestServer(false, &proto)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var traces []RequestTrace
+	s, err := New(WithBaseURL(srv.URL), withRootCAs(srv), WithTrace(func(rt RequestTrace) {
+		mu.Lock()
+		traces = append(traces, rt)
+		mu.Unlock()
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error creating session: %s", err)
+	}
+
+	if _, err := s.Messages(); err != nil {
+		t.Fatalf("unexpected error fetching messages: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(traces) != 2 {
+		t.Fatalf("Got %d traces, want 2", len(traces))
+	}
+
+	first, second := traces[0], traces[1]
+	if first.Endpoint != endpointAddress || first.Reused || first.TLSHandshake == 0 {
+		t.Errorf("Got %+v, want a new connection with a handshake", first)
+	}
+	if second.Endpoint != endpointMessagesAfter || !second.Reused || second.TLSHandshake != 0 {
+		t.Errorf("Got %+v, want a reused connection", second)
+	}
+	if second.StatusCode != http.StatusOK || second.Err != nil {
+		t.Errorf("Got status %d, error %v, want 200", second.StatusCode, second.Err)
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	var proto int32
+	srv := newTLSTestServer(false, &proto)
+	defer srv.Close()
+
+	cfg, _ := newConfig([]Option{withRootCAs(srv)})
+	cfg.sessionCache = tls.NewLRUClientSessionCache(sessionCacheSize)
+
+	for i, want := range []bool{false, true} {
+		conn, err := dialTLS(context.Background(), cfg, "tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("unexpected error dialing: %s", err)
+		}
+
+		// The ticket arrives after the handshake, so read the response
+		// to a request before closing.
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Write(conn)
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatalf("unexpected error reading response: %s", err)
+		}
+		res.Body.Close()
+
+		if got := conn.(*tls.UConn).ConnectionState().DidResume; got != want {
+			t.Errorf("connection %d: Got resumed %v, want %v", i, got, want)
+		}
+		conn.Close()
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// Accepts connections but never answers the ClientHello
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cfg, _ := newConfig([]Option{WithTLSHandshakeTimeout(50 * time.Millisecond)})
+	_, err = dialTLS(context.Background(), cfg, "tcp", l.Addr().String())
+
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Errorf("Got %v, want a timeout", err)
+	}
+}
+
+func TestTLSVersions(t *testing.T) {
+	var version uint32
+	newServer := func(min, max uint16) *httptest.Server {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.StoreUint32(&version, uint32(r.TLS.Version))
+			if r.URL.Path == "/"+endpointAddress {
+				http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+				w.Write([]byte(`{"address":"test@example.com"}`))
+				return
+			}
+			w.Write([]byte(`[]`))
+		}))
+		srv.TLS = &ctls.Config{MinVersion: min, MaxVersion: max}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	tests := []struct {
+		name     string
+		server   [2]uint16
+		opts     []Option
+		want     uint16
+		wantFail bool
+	}{
+		{"default", [2]uint16{ctls.VersionTLS12, ctls.VersionTLS13}, nil, tls.VersionTLS12, false},
+		{"default refused", [2]uint16{ctls.VersionTLS13, ctls.VersionTLS13}, nil, 0, true},
+		{"1.3", [2]uint16{ctls.VersionTLS13, ctls.VersionTLS13}, []Option{WithTLSVersions(tls.VersionTLS12, tls.VersionTLS13)}, tls.VersionTLS13, false},
+		{"1.3 only", [2]uint16{ctls.VersionTLS12, ctls.VersionTLS13}, []Option{WithTLSVersions(tls.VersionTLS13, tls.VersionTLS13)}, tls.VersionTLS13, false},
+		{"1.3 only refused", [2]uint16{ctls.VersionTLS12, ctls.VersionTLS12}, []Option{WithTLSVersions(tls.VersionTLS13, tls.VersionTLS13)}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(tt.server[0], tt.server[1])
+			atomic.StoreUint32(&version, 0)
+
+			_, err := New(append([]Option{WithBaseURL(srv.URL), withRootCAs(srv)}, tt.opts...)...)
+			if tt.wantFail {
+				if err == nil {
+					t.Fatal("Got no error, want the handshake to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error creating session: %s", err)
+			}
+			if got := atomic.LoadUint32(&version); got != uint32(tt.want) {
+				t.Errorf("Got TLS version %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+
+	for _, opt := range []Option{
+		WithTLSVersions(tls.VersionTLS13, tls.VersionTLS12),
+		WithTLSVersions(0x0300, tls.VersionTLS12),
+		WithCipherSuites(),
+	} {
+		if err := Validate(opt); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("Got %v, want ErrInvalidOption", err)
+		}
+	}
+}
+
+// flakyListener drops the first connection it accepts, as if the
+// network failed part way through the handshake.
+type flakyListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil && atomic.AddInt32(&l.accepted, 1) == 1 {
+		conn.Close()
+	}
+
+	return conn, err
+}
+
+func TestHandshakeRetry(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	l := &flakyListener{Listener: srv.Listener}
+	srv.Listener = l
+	srv.StartTLS()
+	defer srv.Close()
+
+	cfg, _ := newConfig([]Option{withRootCAs(srv)})
+	conn, err := dialTLS(context.Background(), cfg, "tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %s", err)
+	}
+	conn.Close()
+
+	if got := atomic.LoadInt32(&l.accepted); got != 2 {
+		t.Errorf("Got %d connections, want 2", got)
+	}
+}
+
+func TestStandardTLSFallback(t *testing.T) {
+	// Only accepts TLS 1.3, which the custom ClientHello doesn't offer
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &ctls.Config{MinVersion: ctls.VersionTLS13}
+	srv.StartTLS()
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	cfg, _ := newConfig([]Option{withRootCAs(srv)})
+	if _, err := dialTLS(context.Background(), cfg, "tcp", addr); err == nil {
+		t.Fatal("Got no error without the fallback, want the handshake to fail")
+	}
+
+	cfg, _ = newConfig([]Option{withRootCAs(srv), WithStandardTLSFallback()})
+	conn, err := dialTLS(context.Background(), cfg, "tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error dialing with the fallback: %s", err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(*ctls.Conn); !ok {
+		t.Errorf("Got %T, want a crypto/tls connection", conn)
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	var remote atomic.Value
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		remote.Store(host)
+		if r.URL.Path == "/"+endpointAddress {
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "token"})
+			w.Write([]byte(`{"address":"test@example.com"}`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	})
+
+	for _, srv := range []*httptest.Server{httptest.NewServer(handler), httptest.NewTLSServer(handler)} {
+		defer srv.Close()
+
+		opts := []Option{WithBaseURL(srv.URL), WithLocalAddr("127.0.0.2")}
+		if srv.TLS != nil {
+			opts = append(opts, withRootCAs(srv))
+		}
+		if _, err := New(opts...); err != nil {
+			t.Fatalf("unexpected error creating session: %s", err)
+		}
+		if got := remote.Load(); got != "127.0.0.2" {
+			t.Errorf("%s: Got connection from %v, want 127.0.0.2", srv.URL, got)
+		}
+	}
+
+	if err := Validate(WithLocalAddr("not an address")); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Got %v for a bad address, want ErrInvalidOption", err)
+	}
+}
@@ -0,0 +1,296 @@
+package tmm
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WatchHandle is returned by Session.Watch and carries the results
+// of the background polling.
+type WatchHandle struct {
+	// Messages receives each new message as it arrives. It is closed
+	// once the watcher has stopped.
+	Messages <-chan Message
+	// Errors receives any error encountered while polling. It is
+	// closed once the watcher has stopped.
+	Errors <-chan error
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	wake   chan struct{}
+
+	mu       sync.Mutex
+	base     time.Duration
+	interval time.Duration
+
+	dropped atomic.Int64
+}
+
+// DropPolicy controls what a watcher does with new messages when the
+// buffer of its Messages channel is full because they aren't being
+// received quickly enough. See WithWatchDropPolicy.
+type DropPolicy int
+
+const (
+	// DropNone waits for room in the buffer, holding up polling.
+	DropNone DropPolicy = iota
+	// DropOldest discards the oldest buffered message to make room.
+	DropOldest
+	// DropLatest discards the new message.
+	DropLatest
+)
+
+// Dropped returns the number of messages discarded because of the
+// watcher's drop policy.
+func (h *WatchHandle) Dropped() int64 {
+	return h.dropped.Load()
+}
+
+// deliver sends m on msgs, following policy if msgs is full. It
+// reports false if ctx is done before m could be sent or dropped.
+func (h *WatchHandle) deliver(ctx context.Context, msgs chan Message, m Message, policy DropPolicy) bool {
+	switch policy {
+	case DropLatest:
+		select {
+		case msgs <- m:
+		default:
+			h.dropped.Add(1)
+		}
+		return true
+	case DropOldest:
+		for {
+			select {
+			case msgs <- m:
+				return true
+			default:
+			}
+
+			// The receiver may have made room in the meantime
+			select {
+			case <-msgs:
+				h.dropped.Add(1)
+			default:
+			}
+		}
+	}
+
+	select {
+	case msgs <- m:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// WatchInterval returns the polling interval currently in effect,
+// including any back-off applied after errors.
+func (h *WatchHandle) WatchInterval() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.interval
+}
+
+// SetInterval changes the polling interval of a running watcher.
+// The next poll is rescheduled to happen d after the previous one.
+// As with Watch, an interval of zero or less polls at the same rate
+// as Next.
+func (h *WatchHandle) SetInterval(d time.Duration) {
+	h.mu.Lock()
+	h.base = defaultInterval(d)
+	h.mu.Unlock()
+
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops the watcher and waits for its goroutine to exit.
+// It is safe to call Stop more than once.
+func (h *WatchHandle) Stop() {
+	h.cancel()
+	<-h.done
+}
+
+// update recalculates the effective interval for the given number
+// of consecutive failures and returns it.
+func (h *WatchHandle) update(b *backoff, failures int) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.interval = b.delay(h.base, failures)
+	return h.interval
+}
+
+// Watch polls for new messages every interval in the background,
+// delivering them on the returned handle until ctx is done or the
+// handle is stopped. An interval of zero or less polls at the same
+// rate as Next.
+//
+// Errors don't stop the watcher. If WithWatchBackoff was given, the
+// interval is stretched after consecutive errors and restored once
+// a poll succeeds.
+func (s *Session) Watch(ctx context.Context, interval time.Duration) *WatchHandle {
+	return s.watch(ctx, interval, nil)
+}
+
+// WatchSubject is like Watch, but only delivers messages whose subject
+// matches the regular expression pattern. The watcher runs until ctx
+// is done, after which both channels are closed.
+//
+// An error wrapping ErrInvalidPattern is returned if pattern isn't
+// valid, in which case nothing is started.
+func (s *Session) WatchSubject(ctx context.Context, pattern string, interval time.Duration) (<-chan Message, <-chan error, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalidPattern, err)
+	}
+
+	h := s.watch(ctx, interval, func(m Message) bool {
+		return re.MatchString(m.Subject)
+	})
+
+	return h.Messages, h.Errors, nil
+}
+
+// WatchFor is like Watch, but stops by itself after d, such as to
+// monitor an inbox for a few minutes while waiting for a sign up to
+// complete. Both channels are closed once it has stopped.
+func (s *Session) WatchFor(d, interval time.Duration) (<-chan Message, <-chan error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	h := s.watch(ctx, interval, nil)
+
+	go func() {
+		<-h.done
+		cancel()
+	}()
+
+	return h.Messages, h.Errors
+}
+
+// watch starts a watcher which only delivers messages for which
+// filter returns true, or every message if filter is nil.
+func (s *Session) watch(ctx context.Context, interval time.Duration, filter func(Message) bool) *WatchHandle {
+	ctx, cancel := context.WithCancel(ctx)
+	interval = defaultInterval(interval)
+
+	msgs := make(chan Message, s.cfg.watchBuffer)
+	errs := make(chan error)
+
+	h := &WatchHandle{
+		Messages: msgs,
+		Errors:   errs,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		wake:     make(chan struct{}, 1),
+		base:     interval,
+		interval: interval,
+	}
+
+	go func() {
+		defer close(h.done)
+		defer close(msgs)
+		defer close(errs)
+
+		last := time.Now()
+		t := time.NewTimer(interval)
+		defer t.Stop()
+
+		failures := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-h.wake:
+				// Reschedule relative to the last poll
+				if !t.Stop() {
+					<-t.C
+				}
+				t.Reset(time.Until(last.Add(h.update(s.cfg.watchBackoff, failures))))
+				continue
+			case <-t.C:
+			}
+
+			last = time.Now()
+			mail, err := s.Latest()
+			if err != nil {
+				failures++
+				h.update(s.cfg.watchBackoff, failures)
+
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+					return
+				}
+			} else {
+				failures = 0
+				h.update(s.cfg.watchBackoff, failures)
+
+				for _, m := range mail {
+					s.notify(m)
+					if filter != nil && !filter(m) {
+						continue
+					}
+
+					if !h.deliver(ctx, msgs, m, s.cfg.watchDrop) {
+						return
+					}
+				}
+			}
+
+			t.Reset(h.WatchInterval())
+		}
+	}()
+
+	return h
+}
+
+// OnMessage registers fn to be called with each new message found by
+// Watch. Each call is made in its own goroutine, so fn must be safe to
+// call concurrently. Messages are still delivered on the channel of
+// each WatchHandle as well.
+func (s *Session) OnMessage(fn func(Message)) {
+	s.mu.Lock()
+	s.onmessage = append(s.onmessage, fn)
+	s.mu.Unlock()
+}
+
+// notify passes m to each function registered with OnMessage.
+func (s *Session) notify(m Message) {
+	s.mu.Lock()
+	handlers := s.onmessage
+	s.mu.Unlock()
+
+	for _, fn := range handlers {
+		go fn(m)
+	}
+}
+
+// backoff describes how the watch interval grows on consecutive errors.
+type backoff struct {
+	min, max time.Duration
+	factor   float64
+}
+
+// delay returns the interval to wait after the given number of
+// consecutive failures. A nil backoff always returns interval.
+func (b *backoff) delay(interval time.Duration, failures int) time.Duration {
+	if b == nil || failures == 0 {
+		return interval
+	}
+
+	d := float64(b.min)
+	for i := 1; i < failures && d < float64(b.max); i++ {
+		d *= b.factor
+	}
+	if d > float64(b.max) {
+		d = float64(b.max)
+	}
+
+	return time.Duration(d)
+}
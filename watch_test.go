@@ -0,0 +1,251 @@
+package tmm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := &backoff{min: time.Second, max: 10 * time.Second, factor: 2}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 500 * time.Millisecond},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := b.delay(500*time.Millisecond, tt.failures); got != tt.want {
+			t.Errorf("%d failures: Got %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+
+	var none *backoff
+	if got := none.delay(time.Second, 3); got != time.Second {
+		t.Errorf("nil backoff: Got %s, want 1s", got)
+	}
+}
+
+func TestWatchBackoff(t *testing.T) {
+	var polls int32
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&polls, 1) <= 2 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"}]`))
+	}, WithWatchBackoff(5*time.Millisecond, 20*time.Millisecond, 2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := s.Watch(ctx, time.Millisecond)
+
+	<-h.Errors
+	<-h.Errors
+	if got := h.WatchInterval(); got != 10*time.Millisecond {
+		t.Errorf("Got interval %s after two errors, want 10ms", got)
+	}
+
+	if m := <-h.Messages; m.ID != "1" {
+		t.Errorf("Got message %q, want 1", m.ID)
+	}
+	if got := h.WatchInterval(); got != time.Millisecond {
+		t.Errorf("Got interval %s after success, want 1ms", got)
+	}
+}
+
+func TestWatchSetIntervalAndStop(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"}]`))
+	})
+
+	// Start with an interval long enough that nothing would arrive
+	h := s.Watch(context.Background(), time.Hour)
+	h.SetInterval(time.Millisecond)
+
+	select {
+	case <-h.Messages:
+	case <-time.After(time.Second):
+		t.Fatal("SetInterval didn't reschedule the next poll")
+	}
+
+	if got := h.WatchInterval(); got != time.Millisecond {
+		t.Errorf("Got interval %s, want 1ms", got)
+	}
+
+	h.Stop()
+	h.Stop()
+
+	if _, ok := <-h.Messages; ok {
+		t.Error("message channel still open after Stop")
+	}
+}
+
+func TestWatchDefaultInterval(t *testing.T) {
+	defer func(d time.Duration) { nextInterval = d }(nextInterval)
+	nextInterval = 20 * time.Millisecond
+
+	var polls atomic.Int32
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		w.Write([]byte(`[]`))
+	})
+
+	h := s.Watch(context.Background(), 0)
+	time.Sleep(50 * time.Millisecond)
+	h.SetInterval(-time.Second)
+	time.Sleep(50 * time.Millisecond)
+	h.Stop()
+
+	if n := polls.Load(); n == 0 || n > 10 {
+		t.Errorf("Got %d polls in 100ms, want one every 20ms or so", n)
+	}
+	if got := h.WatchInterval(); got != nextInterval {
+		t.Errorf("Got interval %s, want the default of %s", got, nextInterval)
+	}
+}
+
+func TestOnMessage(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"}]`))
+	})
+
+	got := make(chan string, 2)
+	s.OnMessage(func(m Message) { got <- "a" + m.ID })
+	s.OnMessage(func(m Message) { got <- "b" + m.ID })
+
+	h := s.Watch(context.Background(), time.Millisecond)
+	defer h.Stop()
+	<-h.Messages
+
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-got:
+			seen[v] = true
+		case <-time.After(time.Second):
+			t.Fatal("handlers not called")
+		}
+	}
+
+	if !seen["a1"] || !seen["b1"] {
+		t.Errorf("Got %v, want both handlers called with message 1", seen)
+	}
+}
+
+func TestWatchSubject(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(r.URL.Path) != "0" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[{"id":"1","subject":"Newsletter","sentDate":"2021-11-28T08:21:06.000+00:00"},{"id":"2","subject":"Verify your account","sentDate":"2021-11-28T08:22:06.000+00:00"}]`))
+	})
+
+	if _, _, err := s.WatchSubject(context.Background(), `(`, time.Millisecond); !errors.Is(err, ErrInvalidPattern) {
+		t.Fatalf("Got %v, want ErrInvalidPattern", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msgs, _, err := s.WatchSubject(ctx, `^Verify`, time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error starting watcher: %s", err)
+	}
+
+	select {
+	case m := <-msgs:
+		if m.ID != "2" {
+			t.Errorf("Got message %s, want 2", m.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message delivered")
+	}
+}
+
+func TestWatchFor(t *testing.T) {
+	s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(r.URL.Path) != "0" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"}]`))
+	})
+
+	start := time.Now()
+	msgs, _ := s.WatchFor(50*time.Millisecond, time.Millisecond)
+
+	var got []string
+	for m := range msgs {
+		got = append(got, m.ID)
+	}
+
+	if len(got) != 1 || got[0] != "1" {
+		t.Errorf("Got messages %q, want [1]", got)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("Watcher stopped after %s, want about 50ms", d)
+	}
+}
+
+func TestWatchDropPolicy(t *testing.T) {
+	tests := []struct {
+		policy DropPolicy
+		want   []string
+	}{
+		{DropOldest, []string{"4", "5"}},
+		{DropLatest, []string{"1", "2"}},
+	}
+
+	for _, tt := range tests {
+		s := newTestSession(t, func(w http.ResponseWriter, r *http.Request) {
+			if path.Base(r.URL.Path) != "0" {
+				w.Write([]byte(`[]`))
+				return
+			}
+			w.Write([]byte(`[
+				{"id":"1","sentDate":"2021-11-28T08:21:06.000+00:00"},
+				{"id":"2","sentDate":"2021-11-28T08:22:06.000+00:00"},
+				{"id":"3","sentDate":"2021-11-28T08:23:06.000+00:00"},
+				{"id":"4","sentDate":"2021-11-28T08:24:06.000+00:00"},
+				{"id":"5","sentDate":"2021-11-28T08:25:06.000+00:00"}
+			]`))
+		}, WithWatchBufferSize(2), WithWatchDropPolicy(tt.policy))
+
+		h := s.Watch(context.Background(), time.Millisecond)
+
+		// Wait for the first poll to overflow the buffer
+		deadline := time.Now().Add(time.Second)
+		for h.Dropped() < 3 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		var got []string
+		for len(got) < 2 {
+			got = append(got, (<-h.Messages).ID)
+		}
+		h.Stop()
+
+		if !reflect.DeepEqual(got, tt.want) || h.Dropped() != 3 {
+			t.Errorf("Policy %d: Got %q with %d dropped, want %q with 3", tt.policy, got, h.Dropped(), tt.want)
+		}
+	}
+
+	if err := Validate(WithWatchDropPolicy(DropOldest)); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Got %v for dropping without a buffer, want ErrInvalidOption", err)
+	}
+}